@@ -4,12 +4,13 @@ package app
 // in encoding/decoding the values for communicating either with the store or with the client
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
-
-	"github.com/dgraph-io/badger"
 )
 
 type userTypeConfig struct {
@@ -41,9 +42,16 @@ var loginUserTypeConfig = &userTypeConfig{
 	TypeName:      "login",
 }
 
+var groupUserTypeConfig = &userTypeConfig{
+	UsePassphrase: false,
+	PathPat:       regexp.MustCompile("^group/([^/]+)$"),
+	NameIdx:       1,
+	TypeName:      "group",
+}
+
 var domainUserTypeConfig = &userTypeConfig{
 	UsePassphrase: false,
-	PathPat:       regexp.MustCompile("^(user/[^/]+)/domain/([^/]+)$"),
+	PathPat:       regexp.MustCompile("^((?:user|group)/[^/]+)/domain/([^/]+)$"),
 	ParentIdx:     1,
 	NameIdx:       2,
 	TypeName:      "domain",
@@ -54,7 +62,7 @@ type domainUserTypeStore struct {
 }
 
 var domainUserTypes = &domainUserTypeStore{
-	userTypes: []*userTypeConfig{rootUserTypeConfig, userUserTypeConfig, loginUserTypeConfig, domainUserTypeConfig},
+	userTypes: []*userTypeConfig{rootUserTypeConfig, userUserTypeConfig, loginUserTypeConfig, groupUserTypeConfig, domainUserTypeConfig},
 }
 
 type loginEntry struct {
@@ -62,10 +70,82 @@ type loginEntry struct {
 	Name       string                 // from path -- name of this login (may be different from stored in /auth)
 	Parent     *loginEntry            // from path -- parent to this login
 	Pubkey     []byte                 // from /auth key
+	PubKeys    [][]byte               // from /auth key -- keys of a multi-signature account (instead of Pubkey)
+	Threshold  int64                  // from /auth key -- number of PubKeys that must sign for a multi-signature account
 	ParentSign []byte                 // from /auth key
 	Attrs      map[string]interface{} // other /auth keys
 	Created    int64
-	Expires    int64
+	Expires    int64 // last block height this account may be used at (0 if it does not expire)
+	Nonce      int64 // number of transactions this account has signed
+}
+
+// nextNonce returns the nonce expected on the next transaction signed by this account (nil for a new account)
+func (login *loginEntry) nextNonce() int64 {
+	if login == nil {
+		return 0
+	}
+	return login.Nonce
+}
+
+// isExpired returns true if this account may no longer be used at the specified block height
+func (login *loginEntry) isExpired(height int64) bool {
+	return login.Expires > 0 && login.Expires < height
+}
+
+// parentSignMessage returns the message that the parent of an account signs to vouch for it
+func parentSignMessage(login *loginEntry) []byte {
+	if len(login.PubKeys) > 0 {
+		return []byte(fmt.Sprintf("%s:%d:%s", login.Type.TypeName, login.Threshold, bytes.Join(login.PubKeys, nil)))
+	}
+	return []byte(fmt.Sprintf("%s:%s", login.Type.TypeName, login.Pubkey))
+}
+
+// isMultiSig returns true if this account is controlled by several keys rather than one
+func (login *loginEntry) isMultiSig() bool {
+	return len(login.PubKeys) > 0
+}
+
+// checkKeys verifies that this account holds either a single key or a usable set of multi-signature keys
+func (login *loginEntry) checkKeys() error {
+	if len(login.PubKeys) == 0 {
+		if login.Threshold != 0 {
+			return errors.New("Account has a threshold but no pubKeys")
+		}
+		return nil
+	}
+	if len(login.Pubkey) > 0 {
+		return errors.New("Account cannot have both a pubKey and pubKeys")
+	}
+	if len(login.PubKeys) > maxMultiSigKeys {
+		return fmt.Errorf("Account cannot have more than %d pubKeys", maxMultiSigKeys)
+	}
+	if login.Threshold < 1 || login.Threshold > int64(len(login.PubKeys)) {
+		return fmt.Errorf("Account threshold must be between 1 and %d", len(login.PubKeys))
+	}
+	for idx, pubKey := range login.PubKeys {
+		if len(pubKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Account pubKeys entry %d is not a valid public key", idx)
+		}
+		for _, other := range login.PubKeys[:idx] {
+			if bytes.Equal(pubKey, other) {
+				return fmt.Errorf("Account pubKeys entry %d is repeated", idx)
+			}
+		}
+	}
+	return nil
+}
+
+// sameKeys returns true if this account is controlled by the same key(s) as other
+func (login *loginEntry) sameKeys(other *loginEntry) bool {
+	if !bytes.Equal(login.Pubkey, other.Pubkey) || login.Threshold != other.Threshold || len(login.PubKeys) != len(other.PubKeys) {
+		return false
+	}
+	for idx, pubKey := range login.PubKeys {
+		if !bytes.Equal(pubKey, other.PubKeys[idx]) {
+			return false
+		}
+	}
+	return true
 }
 
 func (login *loginEntry) path() string {
@@ -82,16 +162,21 @@ func (login *loginEntry) path() string {
 			return "" // must have a user parent
 		}
 		return login.Parent.path() + "/login/" + login.Name
+	case groupUserTypeConfig:
+		if strings.Contains(login.Name, "/") {
+			return "" // name cannot contain slash
+		}
+		return "group/" + login.Name
 	case domainUserTypeConfig:
-		if login.Parent == nil || login.Parent.Type != userUserTypeConfig {
-			return "" // must have a user parent
+		if login.Parent == nil || (login.Parent.Type != userUserTypeConfig && login.Parent.Type != groupUserTypeConfig) {
+			return "" // must have a user or group parent
 		}
 		return login.Parent.path() + "/domain/" + login.Name
 	}
 	return "" // not a recognized login type
 }
 
-func (login *loginEntry) queryAccountData(txn *badger.Txn, path string, query string) error {
+func (login *loginEntry) queryAccountData(txn KVTxn, path string, query string) error {
 	acctPath := path + "/auth"
 	gAcctData, err := GetBadgerVal(txn, acctPath)
 	if err != nil {
@@ -110,6 +195,8 @@ func (login *loginEntry) queryAccountData(txn *badger.Txn, path string, query st
 
 func (login *loginEntry) decodeAccountData(acctData map[string]interface{}, path string, fromUser bool) error {
 	login.Pubkey = []byte{}
+	login.PubKeys = nil
+	login.Threshold = 0
 	login.ParentSign = []byte{}
 	login.Attrs = make(map[string]interface{})
 	for key, val := range acctData {
@@ -126,6 +213,31 @@ func (login *loginEntry) decodeAccountData(acctData map[string]interface{}, path
 			} else {
 				return fmt.Errorf("Found unexpected non-string %v reading %s/auth/pubKey", val, path)
 			}
+		case "pubKeys":
+			keys, ok := val.([]interface{})
+			if !ok {
+				return fmt.Errorf("Found unexpected non-list %v reading %s/auth/pubKeys", val, path)
+			}
+			login.PubKeys = make([][]byte, 0, len(keys))
+			for _, gKey := range keys {
+				if pubKey, ok := gKey.([]byte); ok {
+					login.PubKeys = append(login.PubKeys, pubKey)
+				} else if pubKey, ok := gKey.(string); ok {
+					decPubKey, err := base64.RawURLEncoding.DecodeString(pubKey)
+					if err != nil {
+						return err
+					}
+					login.PubKeys = append(login.PubKeys, decPubKey)
+				} else {
+					return fmt.Errorf("Found unexpected non-string %v reading %s/auth/pubKeys", gKey, path)
+				}
+			}
+		case "threshold":
+			if iThreshold, ok := NumberToInt64(val); ok {
+				login.Threshold = iThreshold
+			} else {
+				return fmt.Errorf("Found unexpected non-number %v reading %s/auth/threshold", val, path)
+			}
 		case "sign":
 			if parentSign, ok := val.([]byte); ok {
 				login.ParentSign = parentSign
@@ -150,7 +262,15 @@ func (login *loginEntry) decodeAccountData(acctData map[string]interface{}, path
 			if iExpires, ok := NumberToInt64(val); ok {
 				login.Expires = iExpires
 			} else {
-				return fmt.Errorf("Found unexpected non-string %v reading %s/auth/created", val, path)
+				return fmt.Errorf("Found unexpected non-number %v reading %s/auth/expires", val, path)
+			}
+		case "nonce":
+			if !fromUser {
+				if iNonce, ok := NumberToInt64(val); ok {
+					login.Nonce = iNonce
+				} else {
+					return fmt.Errorf("Found unexpected non-number %v reading %s/auth/nonce", val, path)
+				}
 			}
 		default:
 			login.Attrs[key] = val
@@ -165,6 +285,14 @@ func (login *loginEntry) assembleAccountData() map[string]interface{} {
 	if len(login.Pubkey) > 0 {
 		result["pubKey"] = login.Pubkey
 	}
+	if len(login.PubKeys) > 0 {
+		pubKeys := make([]interface{}, 0, len(login.PubKeys))
+		for _, pubKey := range login.PubKeys {
+			pubKeys = append(pubKeys, pubKey)
+		}
+		result["pubKeys"] = pubKeys
+		result["threshold"] = login.Threshold
+	}
 	if len(login.ParentSign) > 0 {
 		result["sign"] = login.ParentSign
 	}
@@ -174,13 +302,16 @@ func (login *loginEntry) assembleAccountData() map[string]interface{} {
 	if login.Expires > 0 {
 		result["expires"] = login.Expires
 	}
+	if login.Nonce > 0 {
+		result["nonce"] = login.Nonce
+	}
 	if login.Attrs != nil {
 		for key, val := range login.Attrs {
 			result[key] = val
 		}
 	}
 
-	return nil
+	return result
 }
 
 func (login *loginEntry) assembleQueryData() map[string]interface{} {
@@ -189,6 +320,14 @@ func (login *loginEntry) assembleQueryData() map[string]interface{} {
 	if len(login.Pubkey) > 0 {
 		result["pubKey"] = base64.RawURLEncoding.EncodeToString(login.Pubkey)
 	}
+	if len(login.PubKeys) > 0 {
+		pubKeys := make([]interface{}, 0, len(login.PubKeys))
+		for _, pubKey := range login.PubKeys {
+			pubKeys = append(pubKeys, base64.RawURLEncoding.EncodeToString(pubKey))
+		}
+		result["pubKeys"] = pubKeys
+		result["threshold"] = login.Threshold
+	}
 	if len(login.ParentSign) > 0 {
 		result["sign"] = base64.RawURLEncoding.EncodeToString(login.ParentSign)
 	}
@@ -198,13 +337,16 @@ func (login *loginEntry) assembleQueryData() map[string]interface{} {
 	if login.Expires > 0 {
 		result["expires"] = login.Expires
 	}
+	if login.Nonce > 0 {
+		result["nonce"] = login.Nonce
+	}
 	if login.Attrs != nil {
 		for key, val := range login.Attrs {
 			result[key] = val
 		}
 	}
 
-	return nil
+	return result
 }
 
 func (app *domainUserTypeStore) MatchFromPath(path string) (*loginEntry, string) {
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func testPubKey(key ed25519.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// TestDeletedAccountLeavesNoAccess deletes a user holding a group membership and a grant, and expects whoever registers
+// the name next to hold neither
+func TestDeletedAccountLeavesNoAccess(t *testing.T) {
+	rootKey := testKey(1)
+	carolKey := testKey(2)
+	daveKey := testKey(3)
+	teamKey := testKey(4)
+	newCarolKey := testKey(5)
+	app := newTestApp(t, rootKey)
+
+	runTestBlock(t, app, 1, [][]byte{
+		signTestTx(carolKey, 0, []byte(fmt.Sprintf(`{"user/carol/auth":{"pubKey":"%s"}}`, testPubKey(carolKey)))),
+		signTestTx(daveKey, 0, []byte(fmt.Sprintf(`{"user/dave/auth":{"pubKey":"%s"}}`, testPubKey(daveKey)))),
+	})
+	runTestBlock(t, app, 2, [][]byte{
+		signTestTx(carolKey, 1, []byte(fmt.Sprintf(`{"group/team/auth":{"pubKey":"%s"}}`, testPubKey(teamKey)))),
+		signTestTx(daveKey, 1, []byte(`{"user/dave/grant/1":{"grantee":"user/carol","path":"privStore","access":"read"}}`)),
+	})
+	runTestBlock(t, app, 3, [][]byte{
+		signTestTx(carolKey, 2, []byte(`[{"op":"deleteAccount","key":"user/carol"}]`)),
+	})
+	runTestBlock(t, app, 4, [][]byte{
+		signTestTx(newCarolKey, 0, []byte(fmt.Sprintf(`{"user/carol/auth":{"pubKey":"%s"}}`, testPubKey(newCarolKey)))),
+	})
+
+	txn := app.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	carol := &loginEntry{Type: userUserTypeConfig, Name: "carol"}
+	if role, err := memberRole(txn, "group/team", carol.Name); err != nil || role != groupRoleNone {
+		t.Errorf("re-registered user holds role %d in the group of the deleted one (%v)", role, err)
+	}
+	if granted, err := app.hasGrant(txn, false, carol, "user/dave/privStore/notes"); err != nil || granted {
+		t.Errorf("re-registered user holds the grant made to the deleted one (%v)", err)
+	}
+	for key := range dumpTestStore(t, app) {
+		if key == "user/dave/grant/1" || strings.HasPrefix(key, memberIndexPrefix) || strings.HasPrefix(key, granteeIndexPrefix) {
+			t.Errorf("expected %s to have been deleted along with the account", key)
+		}
+	}
+}
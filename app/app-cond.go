@@ -0,0 +1,87 @@
+package app
+
+// Evaluates the preconditions that a transaction entry may place on the current value of its key, allowing clients to
+// coordinate their writes (write only if the key does not exist yet, only if nobody changed it since it was read, ...)
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// txCondition is read from the "if" map of a transaction entry, each of which must hold for the entry to be applied
+type txCondition struct {
+	exists  *bool  // "exists": whether the key must (or must not) currently exist
+	hash    []byte // "hash": sha256 (base64url) of the stored value, as found in the leaves of the merkle tree
+	created *int64 // "created": the "created" height of the stored value (such as an account record)
+}
+
+func unpackTxCondition(condMap map[string]interface{}) (*txCondition, error) {
+	cond := &txCondition{}
+	for key, val := range condMap {
+		switch key {
+		case "exists":
+			exists, ok := val.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Precondition \"exists\" must be a boolean, found %v", val)
+			}
+			cond.exists = &exists
+		case "hash":
+			strHash, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("Precondition \"hash\" must be a string, found %v", val)
+			}
+			hash, err := base64.RawURLEncoding.DecodeString(strHash)
+			if err != nil {
+				return nil, err
+			}
+			cond.hash = hash
+		case "created":
+			created, ok := NumberToInt64(val)
+			if !ok {
+				return nil, fmt.Errorf("Precondition \"created\" must be an integer, found %v", val)
+			}
+			cond.created = &created
+		default:
+			return nil, fmt.Errorf("Unrecognized precondition %s", key)
+		}
+	}
+	if len(condMap) == 0 {
+		return nil, errors.New("Empty precondition")
+	}
+	return cond, nil
+}
+
+// check returns a description of the first precondition that the current value of key fails, or "" if all hold
+func (cond *txCondition) check(txn KVTxn, key string) (string, error) {
+	rawValue, err := getBadgerRaw(txn, key)
+	if err != nil {
+		return "", err
+	}
+	if cond.exists != nil && *cond.exists != (rawValue != nil) {
+		if *cond.exists {
+			return fmt.Sprintf("%s does not exist", key), nil
+		}
+		return fmt.Sprintf("%s already exists", key), nil
+	}
+	if cond.hash != nil && (rawValue == nil || !bytes.Equal(cond.hash, merkleValueHash(rawValue))) {
+		return fmt.Sprintf("%s does not have the expected hash", key), nil
+	}
+	if cond.created != nil {
+		var created int64
+		if rawValue != nil {
+			value, err := fromBadgerType(rawValue)
+			if err != nil {
+				return "", err
+			}
+			if mapValue, ok := value.(map[string]interface{}); ok {
+				created, _ = NumberToInt64(mapValue["created"])
+			}
+		}
+		if created != *cond.created {
+			return fmt.Sprintf("%s was not created at height %d", key, *cond.created), nil
+		}
+	}
+	return "", nil
+}
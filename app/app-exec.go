@@ -9,8 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 
-	"github.com/dgraph-io/badger"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
 )
 
 type permissionPathEntry struct {
@@ -25,37 +26,64 @@ var permPaths = map[string]*permissionPathEntry{
 	"userPrivStore":   &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/privStore"), false},
 	"userStore":       &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/store"), false},
 	"loginAuth":       &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/login/[^/]+/auth$"), true},
-	"domainAuth":      &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/domain/[^/]+/auth$"), true},
-	"domainPrivStore": &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/domain/[^/]+/privStore"), false},
-	"domainStore":     &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/domain/[^/]+/store"), false},
-	"domainLoc":       &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/domain/[^/]+/loc"), false},
+	"domainAuth":      &permissionPathEntry{regexp.MustCompile("^((?:user|group)/[^/]+)/domain/[^/]+/auth$"), true},
+	"domainPrivStore": &permissionPathEntry{regexp.MustCompile("^((?:user|group)/[^/]+)/domain/[^/]+/privStore"), false},
+	"domainStore":     &permissionPathEntry{regexp.MustCompile("^((?:user|group)/[^/]+)/domain/[^/]+/store"), false},
+	"domainLoc":       &permissionPathEntry{regexp.MustCompile("^((?:user|group)/[^/]+)/domain/[^/]+/loc"), false},
+	"userGrant":       &permissionPathEntry{regexp.MustCompile("^(user/[^/]+)/grant/"), false},
+	"groupPrefix":     &permissionPathEntry{regexp.MustCompile("^(group/[^/]+)/"), false},
+	"groupAuth":       &permissionPathEntry{regexp.MustCompile("^(group/[^/]+)/auth$"), true},
+	"groupMember":     &permissionPathEntry{regexp.MustCompile("^(group/[^/]+)/member/[^/]+$"), false},
+	"groupPrivStore":  &permissionPathEntry{regexp.MustCompile("^(group/[^/]+)/privStore"), false},
+	"groupStore":      &permissionPathEntry{regexp.MustCompile("^(group/[^/]+)/store"), false},
 }
 
 type permissionMapEntry struct {
-	PathPat  string
-	UserType *userTypeConfig
-	CanWrite bool
+	PathPat   string
+	UserType  *userTypeConfig
+	CanWrite  bool
+	GroupRole int // if set, the first grouping of the path must be a group in which the user holds at least this role
 }
 
-var permissions = []permissionMapEntry{
-	permissionMapEntry{"all", rootUserTypeConfig, true},
-	permissionMapEntry{"userPrefix", userUserTypeConfig, false},
-	permissionMapEntry{"userAuth", userUserTypeConfig, true},
-	permissionMapEntry{"userPrivStore", userUserTypeConfig, true},
-	permissionMapEntry{"userPrivStore", loginUserTypeConfig, true},
-	permissionMapEntry{"userStore", nil, false},
-	permissionMapEntry{"userStore", userUserTypeConfig, true},
-	permissionMapEntry{"userStore", loginUserTypeConfig, true},
-	permissionMapEntry{"loginAuth", loginUserTypeConfig, true},
-	permissionMapEntry{"domainAuth", loginUserTypeConfig, true},
-	permissionMapEntry{"domainPrivStore", loginUserTypeConfig, true},
-	permissionMapEntry{"domainPrivStore", domainUserTypeConfig, true},
-	permissionMapEntry{"domainStore", nil, false},
-	permissionMapEntry{"domainStore", loginUserTypeConfig, true},
-	permissionMapEntry{"domainStore", domainUserTypeConfig, true},
-	permissionMapEntry{"domainLoc", nil, false},
-	permissionMapEntry{"domainLoc", loginUserTypeConfig, true},
-	permissionMapEntry{"domainLoc", domainUserTypeConfig, true},
+// defaultPermissions is the permission table a new chain starts with (see permissions.go).  A running chain only sees
+// the table it has stored, a rule added here reaches it once root sends the transaction made by DoPermissions
+var defaultPermissions = []permissionMapEntry{
+	permissionMapEntry{"all", rootUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userPrefix", userUserTypeConfig, false, groupRoleNone},
+	permissionMapEntry{"userAuth", userUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userPrivStore", userUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userPrivStore", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userStore", nil, false, groupRoleNone},
+	permissionMapEntry{"userStore", userUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userStore", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"loginAuth", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainAuth", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainPrivStore", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainPrivStore", domainUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainStore", nil, false, groupRoleNone},
+	permissionMapEntry{"domainStore", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainStore", domainUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainLoc", nil, false, groupRoleNone},
+	permissionMapEntry{"domainLoc", loginUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"domainLoc", domainUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"userGrant", userUserTypeConfig, true, groupRoleNone},
+	permissionMapEntry{"groupPrefix", userUserTypeConfig, false, groupRoleMember},
+	permissionMapEntry{"groupPrefix", loginUserTypeConfig, false, groupRoleMember},
+	permissionMapEntry{"groupAuth", userUserTypeConfig, true, groupRoleOwner},
+	permissionMapEntry{"groupMember", userUserTypeConfig, true, groupRoleAdmin},
+	permissionMapEntry{"groupPrivStore", userUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"groupPrivStore", loginUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"groupStore", nil, false, groupRoleNone},
+	permissionMapEntry{"groupStore", userUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"groupStore", loginUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainAuth", userUserTypeConfig, true, groupRoleAdmin},
+	permissionMapEntry{"domainAuth", loginUserTypeConfig, true, groupRoleAdmin},
+	permissionMapEntry{"domainPrivStore", userUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainPrivStore", loginUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainStore", userUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainStore", loginUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainLoc", userUserTypeConfig, true, groupRoleMember},
+	permissionMapEntry{"domainLoc", loginUserTypeConfig, true, groupRoleMember},
 }
 
 func verifySignature(pubKey []byte, message []byte, sig []byte) bool {
@@ -65,9 +93,40 @@ func verifySignature(pubKey []byte, message []byte, sig []byte) bool {
 	return ed25519.Verify(pubKey, message, sig)
 }
 
-func (app *AthenaStoreApplication) isAuth(txn *badger.Txn, pubKey ed25519.PublicKey) (*loginEntry, error) {
+// isAuth returns the account that may sign with the specified key (or multi-signature envelope), or errAccountExpired
+// if it (or its parent) has lapsed
+func (app *AthenaStoreApplication) isAuth(txn KVTxn, pubKey ed25519.PublicKey, multiSig *multiSigAuth) (*loginEntry, error) {
+	var login *loginEntry
+	var err error
+	if multiSig != nil {
+		login, err = app.lookupMultiSig(txn, multiSig)
+	} else {
+		login, err = app.lookupAuth(txn, pubKey)
+	}
+	if err != nil || login == nil {
+		return login, err
+	}
+	height := app.currentHeight()
+	if login.isExpired(height) || (login.Parent != nil && login.Parent.isExpired(height)) {
+		return nil, errAccountExpired
+	}
+	return login, nil
+}
 
-	keyQuery := "keymap/" + base64.RawURLEncoding.EncodeToString(pubKey)
+// authErrorCode returns the response code to report when isAuth fails
+func authErrorCode(err error) uint32 {
+	if err == errAccountExpired || err == errNotEnoughSigners {
+		return ErrorUnauth
+	}
+	if err == errUnknownAccount {
+		return ErrorUnknownUser
+	}
+	return ErrorUnexpected
+}
+
+func (app *AthenaStoreApplication) lookupAuth(txn KVTxn, pubKey ed25519.PublicKey) (*loginEntry, error) {
+
+	keyQuery := "keyMap/" + base64.RawURLEncoding.EncodeToString(pubKey)
 	gKeyPath, err := GetBadgerVal(txn, keyQuery)
 	if err != nil {
 		return nil, err // error or no key found
@@ -101,37 +160,78 @@ func (app *AthenaStoreApplication) isAuth(txn *badger.Txn, pubKey ed25519.Public
 	}
 
 	if parentPath != "" {
-		if len(login.ParentSign) == 0 {
-			return nil, errors.New("Account is a child object but is missing a signature")
-		}
-
-		parentLogin, _ := domainUserTypes.MatchFromPath(parentPath)
-		if parentLogin == nil {
-			return nil, fmt.Errorf("Unsupported parent key path %s", parentPath)
-		}
-
-		login.Parent = parentLogin
-		err = parentLogin.queryAccountData(txn, parentPath, keyPath)
+		err = app.verifyParentSign(txn, login, parentPath, keyPath)
 		if err != nil {
 			return nil, err
 		}
-
-		if len(parentLogin.Pubkey) == 0 {
-			return nil, fmt.Errorf("Account object %s/auth missing pubKey", parentPath)
-		}
-		toSign := []byte(fmt.Sprintf("%s:%s", login.Type.TypeName, login.Pubkey))
-		if !verifySignature(parentLogin.Pubkey, toSign, login.ParentSign) {
-			return nil, errors.New("Account is a child object but its signature was failed by its parent")
-		}
 	}
 	return login, nil
 }
 
-func (app *AthenaStoreApplication) createRootUser(txn *badger.Txn, pubkey []byte) error {
-	login := &loginEntry{
-		Type:   rootUserTypeConfig,
-		Pubkey: pubkey,
+// verifyParentSign loads the parent of login and checks that it signed login
+func (app *AthenaStoreApplication) verifyParentSign(txn KVTxn, login *loginEntry, parentPath string, keyPath string) error {
+	if len(login.ParentSign) == 0 {
+		return errors.New("Account is a child object but is missing a signature")
+	}
+
+	parentLogin, _ := domainUserTypes.MatchFromPath(parentPath)
+	if parentLogin == nil {
+		return fmt.Errorf("Unsupported parent key path %s", parentPath)
+	}
+
+	login.Parent = parentLogin
+	err := parentLogin.queryAccountData(txn, parentPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	if len(parentLogin.Pubkey) == 0 {
+		return fmt.Errorf("Account object %s/auth missing pubKey", parentPath)
+	}
+	if !verifySignature(parentLogin.Pubkey, parentSignMessage(login), login.ParentSign) {
+		return errors.New("Account is a child object but its signature was failed by its parent")
+	}
+	return nil
+}
+
+// bumpNonce advances the nonce of the key (or multi-signature account) signing a transaction past the nonce the
+// transaction carried.  The transaction may have created the account holding the key, or it may have since changed
+// its key or deleted itself, in which case the tombstone of the key is advanced instead
+func (app *AthenaStoreApplication) bumpNonce(txn KVTxn, tx *athenaTx) error {
+	var login *loginEntry
+	var tombstoneKey string
+	var err error
+	if tx.MultiSig != nil {
+		login, _, err = multiSigAccount(txn, tx.MultiSig.acctPath)
+		tombstoneKey = multiSigTombstoneKey(tx.MultiSig.acctPath)
+	} else {
+		login, err = app.lookupAuth(txn, tx.Pkey)
+		tombstoneKey = nonceTombstoneKey(tx.Pkey)
+	}
+	if err != nil {
+		return err
+	}
+	if login == nil {
+		encNonce, err := ToBadgerType(tx.Nonce + 1)
+		if err != nil {
+			return err
+		}
+		return app.storeRaw(txn, tombstoneKey, encNonce)
+	}
+	acctPath := login.path() + "/auth"
+	gAcctData, err := GetBadgerVal(txn, acctPath)
+	if err != nil || gAcctData == nil {
+		return err
 	}
+	acctData, ok := gAcctData.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Unexpected account object %v while fetching from %s", gAcctData, acctPath)
+	}
+	acctData["nonce"] = tx.Nonce + 1
+	return app.setKey(txn, acctPath, acctData)
+}
+
+func (app *AthenaStoreApplication) createRootUser(txn KVTxn, login *loginEntry) error {
 	path := login.path()
 	if path == "" || login.Parent != nil {
 		return errors.New("Attempt to create an invalid user")
@@ -150,29 +250,135 @@ func (app *AthenaStoreApplication) createRootUser(txn *badger.Txn, pubkey []byte
 	return app.setKey(txn, acctPath, newAcctData)
 }
 
-func (app *AthenaStoreApplication) canAccess(forWrite bool, login *loginEntry, path string) (isGranted bool, isAuthPath bool) {
-	prefixCache := make(map[string][]string)
+// canDeleteAccount checks that the account at acctPath may be deleted by login: only by root, the account itself,
+// the account it belongs to, or (for groups) an owner of the group or an admin of the group owning it
+func (app *AthenaStoreApplication) canDeleteAccount(txn KVTxn, login *loginEntry, acctPath string) (code uint32, codeDescr string) {
+	acct, _ := domainUserTypes.MatchFromPath(acctPath)
+	if acct == nil || acct.Type == rootUserTypeConfig {
+		return ErrorBadFormat, fmt.Sprintf("%s is not an account that can be deleted", acctPath)
+	}
+	if login == nil {
+		return ErrorUnknownUser, fmt.Sprintf("Deleting account %s requires a valid user", acctPath)
+	}
+	if login.Type == rootUserTypeConfig {
+		return 0, ""
+	}
+	loginPath := login.path()
+	if loginPath != "" && (loginPath == acctPath || strings.HasPrefix(acctPath, loginPath+"/")) {
+		return 0, ""
+	}
+	if matches := groupOfPathPat.FindStringSubmatch(acctPath); matches != nil {
+		role := groupRoleAdmin
+		if matches[1] == acctPath {
+			role = groupRoleOwner
+		}
+		hasRole, err := app.hasGroupRole(txn, login, matches[1], role)
+		if err != nil {
+			return ErrorUnexpected, err.Error()
+		}
+		if hasRole {
+			return 0, ""
+		}
+	}
+	return ErrorUnauth, fmt.Sprintf("Not authorized to delete account %s", acctPath)
+}
+
+// indexedKeys returns the keys pointed at by the index entries under prefix
+func indexedKeys(txn KVTxn, prefix string) ([]string, error) {
+	var keys []string
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(prefix)})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		key, err := fromBadgerType(val)
+		if err != nil {
+			return nil, err
+		}
+		if strKey, ok := key.(string); ok {
+			keys = append(keys, strKey)
+		}
+	}
+	return keys, nil
+}
+
+// deleteAccount deletes an account and everything beneath it, along with any symlinks to them.  The group memberships
+// of a deleted user and the grants naming the account go too, so that whoever registers the name next starts afresh
+func (app *AthenaStoreApplication) deleteAccount(txn KVTxn, acctPath string) ([]abcitypes.Event, error) {
+	var keys []string
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(acctPath + "/"), KeysOnly: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+
+	refKeys, err := indexedKeys(txn, granteeIndexPrefix+acctPath+"/")
+	if err != nil {
+		return nil, err
+	}
+	if acct, _ := domainUserTypes.MatchFromPath(acctPath); acct != nil && acct.Type == userUserTypeConfig {
+		memberKeys, err := indexedKeys(txn, memberIndexPrefix+acct.Name+"/")
+		if err != nil {
+			return nil, err
+		}
+		refKeys = append(refKeys, memberKeys...)
+	}
+	for _, key := range refKeys {
+		if !strings.HasPrefix(key, acctPath+"/") {
+			keys = append(keys, key)
+		}
+	}
+
+	events := make([]abcitypes.Event, 0, len(keys))
+	for _, key := range keys {
+		event, err := writeEvent(txn, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		err = app.setKey(txn, key, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (app *AthenaStoreApplication) canAccess(txn KVTxn, forWrite bool, login *loginEntry, path string) (isGranted bool, isAuthPath bool, err error) {
 	matchPrefix := ""
 
-	for _, perm := range permissions {
+	for _, perm := range app.permissions {
 		if login.Type != perm.UserType || (forWrite && !perm.CanWrite) {
 			// not intended for our user type or it's r/o, so skip
 			continue
 		}
-		permPath := permPaths[perm.PathPat]
-		if _, ok := prefixCache[perm.PathPat]; !ok {
-			prefixCache[perm.PathPat] = permPath.PathPat.FindStringSubmatch(path)
-		}
-		matches := prefixCache[perm.PathPat]
+		matches := perm.PathPat.FindStringSubmatch(path)
 		if matches == nil {
 			continue
 		}
-		if len(matches) <= 1 {
+		if perm.GroupRole != groupRoleNone {
+			// this pattern requires us to hold a role in the group it names
+			hasRole, err := app.hasGroupRole(txn, login, matches[1], perm.GroupRole)
+			if err != nil {
+				return false, false, err
+			}
+			if hasRole {
+				isGranted = true
+				if perm.IsAuth {
+					isAuthPath = true
+				}
+			}
+			continue
+		}
+		if !perm.OwnerMatch {
 			// this pattern matches with no qualifiers, accept it and go
 			isGranted = true
-			if permPath.IsAuth {
+			if perm.IsAuth {
 				isAuthPath = true
 			}
+			continue
 		}
 		if matchPrefix == "" {
 			// the permission is asking for a matching user, might as well figure out what ours is
@@ -184,40 +390,76 @@ func (app *AthenaStoreApplication) canAccess(forWrite bool, login *loginEntry, p
 		}
 		if matches[1] == matchPrefix {
 			isGranted = true
-			if permPath.IsAuth {
+			if perm.IsAuth {
 				isAuthPath = true
 			}
 		}
 	}
+	if !isGranted && forWrite {
+		// anyone may found a group that does not yet exist
+		isGranted, err = app.canCreateGroup(txn, login, path)
+		if err != nil || isGranted {
+			isAuthPath = isGranted
+			return
+		}
+	}
+	if !isGranted {
+		// the owner may have shared this with us
+		isGranted, err = app.hasGrant(txn, forWrite, login, path)
+	}
 	return
 }
 
-func (app *AthenaStoreApplication) isValid(tx *athenaTx, login *loginEntry) (code uint32, codeDescr string) {
+func (app *AthenaStoreApplication) isValid(txn KVTxn, tx *athenaTx, login *loginEntry) (code uint32, codeDescr string) {
 	for _, keyValue := range tx.Msg {
-		key, err := resolveSymlinkPath(app.currentBatch, keyValue.key)
+		key, err := app.resolveSymlinkPath(txn, keyValue.key)
 		if err != nil {
 			return ErrorUnexpected, err.Error()
 		}
 		if key == "" {
 			return ErrorNotFound, fmt.Sprintf("Path %s could not be resolved", keyValue.key)
 		}
+		if strings.HasPrefix(key, "mesh/") {
+			return ErrorUnauth, fmt.Sprintf("Path %s is reserved for the application", keyValue.key)
+		}
+		if strings.HasPrefix(key, "config/") && (login == nil || login.Type != rootUserTypeConfig) {
+			return ErrorUnauth, fmt.Sprintf("Only root may change the chain configuration at %s", keyValue.key)
+		}
+		if keyValue.op == opDeleteAccount {
+			code, codeDescr = app.canDeleteAccount(txn, login, key)
+			if code != 0 {
+				return code, codeDescr
+			}
+			continue
+		}
+		if keyValue.op == opRotateKey {
+			code, codeDescr = canRotateKey(login, key)
+			if code != 0 {
+				return code, codeDescr
+			}
+			continue
+		}
 		if login != nil {
-			canAccess, _ := app.canAccess(true, login, key)
+			canAccess, _, err := app.canAccess(txn, true, login, key)
+			if err != nil {
+				return ErrorUnexpected, err.Error()
+			}
 			if !canAccess {
 				return ErrorUnauth, fmt.Sprintf("Not authorized to write to %s", keyValue.key)
 			}
-		} else if valueAsMap, ok := keyValue.value.(map[string]interface{}); ok {
+		} else {
 			canAccess := false
 
 			// we need to special-case users creating a new user account, which would appear as a self-signed write to a nonexistent userAuth location
+			valueAsMap, isMap := keyValue.value.(map[string]interface{})
 			userAuthPath := permPaths["userAuth"].PathPat.FindStringSubmatch(key)
-			if userAuthPath != nil {
+			if isMap && keyValue.op == "" && userAuthPath != nil {
 				// attempt to decode the value into a login Entry
-				reqAcctData := &loginEntry{Type: userUserTypeConfig}
+				reqAcctData := &loginEntry{Type: userUserTypeConfig, Name: userAuthPath[2]}
 				err := reqAcctData.decodeAccountData(valueAsMap, key, true)
 				if err == nil && reqAcctData.Name != "" && bytes.Equal(reqAcctData.Pubkey, tx.Pkey) {
 					// okay this is properly self-signed, if the user doesn't exist then we'll consider this a valid createUser request
-					if gAcctData, err := GetBadgerVal(app.currentBatch, key); gAcctData != nil && err == nil {
+					if gAcctData, err := GetBadgerVal(txn, key); gAcctData != nil && err == nil {
 						return ErrorUnauth, fmt.Sprintf("User %s already exists", userAuthPath[2])
 					}
 					canAccess = true
@@ -231,29 +473,117 @@ func (app *AthenaStoreApplication) isValid(tx *athenaTx, login *loginEntry) (cod
 	return 0, ""
 }
 
-func (app *AthenaStoreApplication) executeTx(tx *athenaTx, login *loginEntry) (code uint32, codeDescr string) {
+func (app *AthenaStoreApplication) executeTx(txn KVTxn, tx *athenaTx, login *loginEntry) (code uint32, codeDescr string, events []abcitypes.Event) {
+	events = []abcitypes.Event{txEvent(login, tx)}
 	for _, keyValue := range tx.Msg {
-		key, err := resolveSymlinkPath(app.currentBatch, keyValue.key)
+		key, err := app.resolveSymlinkPath(txn, keyValue.key)
 		if err != nil {
-			return ErrorUnexpected, err.Error()
+			return ErrorUnexpected, err.Error(), nil
 		}
 		if key == "" {
-			return ErrorNotFound, fmt.Sprintf("Path %s could not be resolved", keyValue.key)
+			return ErrorNotFound, fmt.Sprintf("Path %s could not be resolved", keyValue.key), nil
+		}
+		if keyValue.op == opDeleteAccount {
+			code, codeDescr = app.canDeleteAccount(txn, login, key)
+			if code != 0 {
+				return code, codeDescr, nil
+			}
+		}
+		if keyValue.op == opRotateKey {
+			code, codeDescr = canRotateKey(login, key)
+			if code != 0 {
+				return code, codeDescr, nil
+			}
+		}
+		if keyValue.cond != nil {
+			condKey := key
+			if keyValue.op == opDeleteAccount || keyValue.op == opRotateKey {
+				condKey = key + "/auth" // preconditions on an account apply to its account record
+			}
+			mismatch, err := keyValue.cond.check(txn, condKey)
+			if err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
+			if mismatch != "" {
+				return ErrorPrecondition, "Precondition failed: " + mismatch, nil
+			}
+		}
+		if keyValue.op == opDeleteAccount {
+			acctEvents, err := app.deleteAccount(txn, key)
+			if err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
+			events = append(events, acctEvents...)
+			continue
+		}
+		if keyValue.op == opRotateKey {
+			event, err := writeEvent(txn, key+"/auth", keyValue.value)
+			if err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
+			code, codeDescr = app.rotateKey(txn, key, keyValue.value)
+			if code != 0 {
+				return code, codeDescr, nil
+			}
+			events = append(events, event)
+			continue
+		}
+		if keyValue.op != "" {
+			// alter the value currently stored here, from here on this is just like any other write
+			keyValue.value, err = applyTxOp(txn, key, keyValue)
+			if err != nil {
+				return ErrorBadFormat, fmt.Sprintf("Unable to %s %s: %s", keyValue.op, keyValue.key, err.Error()), nil
+			}
+		}
+		if key == permissionsKey && keyValue.value != nil {
+			// make sure that the new table is usable before it takes effect
+			if _, err := parsePermissionRules(keyValue.value); err != nil {
+				return ErrorBadFormat, err.Error(), nil
+			}
+		}
+		if key == symlinksKey && keyValue.value != nil {
+			if _, err := parseSymlinkEntries(keyValue.value); err != nil {
+				return ErrorBadFormat, err.Error(), nil
+			}
+		}
+		if grantPat.MatchString(key) && keyValue.value != nil {
+			if _, err := parseAccessGrant(keyValue.value); err != nil {
+				return ErrorBadFormat, err.Error(), nil
+			}
+		}
+		if groupMemberPat.MatchString(key) {
+			code, codeDescr = app.checkMemberChange(txn, login, key, keyValue.value)
+			if code != 0 {
+				return code, codeDescr, nil
+			}
+		}
+		newGroup, err := isNewGroup(txn, key, keyValue.value)
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
 		}
 
 		if login != nil {
-			canAccess, isAuthPath := app.canAccess(true, login, key)
+			canAccess, isAuthPath, err := app.canAccess(txn, true, login, key)
+			if err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
 			if !canAccess {
-				return ErrorUnauth, fmt.Sprintf("Not authorized to write to %s", keyValue.key)
+				return ErrorUnauth, fmt.Sprintf("Not authorized to write to %s", keyValue.key), nil
 			}
 			if isAuthPath {
-				reqAcctData, _ := domainUserTypes.MatchFromPath(key)
+				reqAcctData, parentPath := domainUserTypes.MatchFromPath(strings.TrimSuffix(key, "/auth"))
 				if reqAcctData == nil {
-					return ErrorUnexpected, fmt.Sprintf("we're told that %s is an auth keypath but cannot resolve the token type?", keyValue.key)
+					return ErrorUnexpected, fmt.Sprintf("we're told that %s is an auth keypath but cannot resolve the token type?", keyValue.key), nil
+				}
+				if parentPath != "" {
+					reqAcctData.Parent, _ = domainUserTypes.MatchFromPath(parentPath)
+					if reqAcctData.Parent == nil {
+						return ErrorUnexpected, fmt.Sprintf("Unsupported parent key path %s", parentPath), nil
+					}
 				}
 
 				// retrieve the existing auth token (if there is one)
-				if gAcctData, err := GetBadgerVal(app.currentBatch, key); gAcctData != nil && err == nil {
+				if gAcctData, err := GetBadgerVal(txn, key); gAcctData != nil && err == nil {
 					acctData, ok := gAcctData.(map[string]interface{})
 					if ok {
 						err = reqAcctData.decodeAccountData(acctData, key, false)
@@ -264,69 +594,101 @@ func (app *AthenaStoreApplication) executeTx(tx *athenaTx, login *loginEntry) (c
 				if reqAcctData.Created == 0 {
 					reqAcctData.Created = app.treeState.lastBlockHeight + 1
 				}
+				oldExpires := reqAcctData.Expires
 
 				// import the new auth data into this token
 				acctData, ok := keyValue.value.(map[string]interface{})
 				if !ok {
-					return ErrorBadFormat, fmt.Sprintf("Attempt to change %s which is an auth key but the value is not a map", keyValue.key)
+					return ErrorBadFormat, fmt.Sprintf("Attempt to change %s which is an auth key but the value is not a map", keyValue.key), nil
 				}
 				err := reqAcctData.decodeAccountData(acctData, key, true)
+				if err == nil {
+					err = reqAcctData.checkKeys()
+				}
 				if err != nil {
-					return ErrorBadFormat, err.Error()
+					return ErrorBadFormat, err.Error(), nil
+				}
+				canChange, err := app.canChangeExpiry(txn, login, reqAcctData, oldExpires)
+				if err != nil {
+					return ErrorUnexpected, err.Error(), nil
+				}
+				if !canChange {
+					return ErrorUnauth, fmt.Sprintf("Not authorized to extend the expiry of %s", keyValue.key), nil
 				}
 				if reqAcctData.Parent != nil {
 					parentLogin := reqAcctData.Parent
 					parentPath := parentLogin.path()
-					err := parentLogin.queryAccountData(app.currentBatch, parentPath, parentPath)
+					err := parentLogin.queryAccountData(txn, parentPath, parentPath)
 					if err != nil {
-						return ErrorBadFormat, err.Error()
+						return ErrorBadFormat, err.Error(), nil
 					}
 					if len(parentLogin.Pubkey) == 0 {
-						return ErrorBadFormat, fmt.Sprintf("Account object %s/auth missing pubKey", parentPath)
+						return ErrorBadFormat, fmt.Sprintf("Account object %s/auth missing pubKey", parentPath), nil
 					}
-					toSign := []byte(fmt.Sprintf("%s:%s", reqAcctData.Type.TypeName, reqAcctData.Pubkey))
-					if !verifySignature(parentLogin.Pubkey, toSign, reqAcctData.ParentSign) {
-						return ErrorBadFormat, "Account is a child object but its signature was failed by its parent"
+					if !verifySignature(parentLogin.Pubkey, parentSignMessage(reqAcctData), reqAcctData.ParentSign) {
+						return ErrorBadFormat, "Account is a child object but its signature was failed by its parent", nil
 					}
 				}
 
 				// write it back out as a new value
 				keyValue.value = reqAcctData.assembleAccountData()
 			}
-		} else if valueAsMap, ok := keyValue.value.(map[string]interface{}); ok {
+		} else {
 			// we need to special-case users creating a new user account, which would appear as a self-signed write to a nonexistent userAuth location
 			canAccess := false
+			valueAsMap, isMap := keyValue.value.(map[string]interface{})
 			userAuthPath := permPaths["userAuth"].PathPat.FindStringSubmatch(key)
-			if userAuthPath != nil {
+			if isMap && keyValue.op == "" && userAuthPath != nil {
 				// attempt to decode the value into a login Entry
 				reqAcctData := &loginEntry{
 					Type:    userUserTypeConfig,
+					Name:    userAuthPath[2],
 					Created: app.treeState.lastBlockHeight + 1,
 				}
 				err := reqAcctData.decodeAccountData(valueAsMap, key, true)
 				if err == nil && reqAcctData.Name != "" && bytes.Equal(reqAcctData.Pubkey, tx.Pkey) {
 					// okay this is properly self-signed, if the user doesn't exist then we'll consider this a valid createUser request
-					if gAcctData, err := GetBadgerVal(app.currentBatch, key); gAcctData != nil && err == nil {
-						return ErrorUnauth, fmt.Sprintf("User %s already exists", userAuthPath[2])
+					if gAcctData, err := GetBadgerVal(txn, key); gAcctData != nil && err == nil {
+						return ErrorUnauth, fmt.Sprintf("User %s already exists", userAuthPath[2]), nil
 					}
 					canAccess = true
 					keyValue.value = reqAcctData.assembleAccountData()
 				}
 			}
 			if !canAccess {
-				return ErrorUnknownUser, fmt.Sprintf("Did not recognize key %s", base64.RawURLEncoding.EncodeToString(tx.Pkey))
+				return ErrorUnknownUser, fmt.Sprintf("Did not recognize key %s", base64.RawURLEncoding.EncodeToString(tx.Pkey)), nil
 			}
 		}
-		err = app.setKey(app.currentBatch, key, keyValue.value)
+		event, err := writeEvent(txn, key, keyValue.value)
 		if err != nil {
-			return ErrorUnexpected, err.Error()
+			return ErrorUnexpected, err.Error(), nil
+		}
+		events = append(events, event)
+		err = app.setKey(txn, key, keyValue.value)
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
+		}
+		if newGroup && login != nil {
+			groupEvents, err := app.addGroupCreator(txn, key, login)
+			if err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
+			events = append(events, groupEvents...)
 		}
 	}
-	return 0, ""
+	return 0, "", events
 }
 
-func (app *AthenaStoreApplication) doQuery(txn *badger.Txn, key string, login *loginEntry) (code uint32, codeDescr string, response interface{}) {
-	fullKey, err := resolveSymlinkPath(txn, key)
+func (app *AthenaStoreApplication) doQuery(txn KVTxn, key string, login *loginEntry) (code uint32, codeDescr string, response interface{}) {
+	listQuery, err := parseListQuery(key)
+	if err != nil {
+		return ErrorBadFormat, err.Error(), nil
+	}
+	if listQuery != nil {
+		return app.doList(txn, listQuery, login)
+	}
+
+	fullKey, err := app.resolveSymlinkPath(txn, key)
 	if err != nil {
 		return ErrorUnexpected, err.Error(), nil
 	}
@@ -334,12 +696,15 @@ func (app *AthenaStoreApplication) doQuery(txn *badger.Txn, key string, login *l
 		return ErrorOk, "", nil // no key value
 	}
 	if login != nil {
-		canAccess, isAuthPath := app.canAccess(false, login, fullKey)
+		canAccess, isAuthPath, err := app.canAccess(txn, false, login, fullKey)
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
+		}
 		if !canAccess {
 			return ErrorUnauth, fmt.Sprintf("Not authorized to read from %s", key), nil
 		}
 		if isAuthPath {
-			reqAcctData, _ := domainUserTypes.MatchFromPath(fullKey)
+			reqAcctData, _ := domainUserTypes.MatchFromPath(strings.TrimSuffix(fullKey, "/auth"))
 			if reqAcctData == nil {
 				return ErrorUnexpected, fmt.Sprintf("we're told that %s is an auth keypath but cannot resolve the token type?", key), nil
 			}
@@ -379,7 +744,7 @@ func (app *AthenaStoreApplication) doQuery(txn *badger.Txn, key string, login *l
 		return ErrorUnauth, fmt.Sprintf("Query of %s requires a valid user", key), nil
 	}
 
-	reqAcctData, _ := domainUserTypes.MatchFromPath(fullKey)
+	reqAcctData, _ := domainUserTypes.MatchFromPath(userAuthPath[1])
 	if reqAcctData == nil {
 		return ErrorUnexpected, fmt.Sprintf("we're told that %s is an auth keypath but cannot resolve the token type?", key), nil
 	}
@@ -406,6 +771,7 @@ func (app *AthenaStoreApplication) doQuery(txn *badger.Txn, key string, login *l
 		Type:   reqAcctData.Type,
 		Pubkey: reqAcctData.Pubkey,
 		Attrs:  reqAcctData.Attrs,
+		Nonce:  reqAcctData.Nonce,
 	}
 	return ErrorOk, "", limitedData.assembleAccountData()
 }
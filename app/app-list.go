@@ -0,0 +1,154 @@
+package app
+
+// Handles queries that list everything under a prefix rather than fetching a single key.  These take the form
+// list:<prefix>?limit=N&after=<key> (a flat list of keys) or tree:<prefix>?limit=N&after=<key> (the keys and their
+// values folded into a nested map).  If more keys remain the response carries "next", to be passed as "after".  As
+// only so many keys are examined per query, a response may carry "next" while holding fewer keys than requested
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+	listMaxScan      = 10000 // number of keys examined by a single query, whether or not they are returned
+)
+
+type listQuery struct {
+	tree   bool   // true to return a nested map of values rather than a list of keys
+	prefix string // prefix to list
+	after  string // only return keys after this one
+	limit  int    // maximum number of keys to return
+}
+
+// parseListQuery recognizes a list: or tree: query, returning nil if this is a query for a single key
+func parseListQuery(path string) (*listQuery, error) {
+	query := &listQuery{limit: listDefaultLimit}
+	switch {
+	case strings.HasPrefix(path, "list:"):
+		path = path[len("list:"):]
+	case strings.HasPrefix(path, "tree:"):
+		query.tree = true
+		path = path[len("tree:"):]
+	default:
+		return nil, nil
+	}
+
+	if qPos := strings.Index(path, "?"); qPos >= 0 {
+		opts, err := url.ParseQuery(path[qPos+1:])
+		if err != nil {
+			return nil, err
+		}
+		path = path[:qPos]
+		if limit := opts.Get("limit"); limit != "" {
+			iLimit, err := strconv.Atoi(limit)
+			if err != nil || iLimit <= 0 {
+				return nil, fmt.Errorf("Unexpected limit %s on list query", limit)
+			}
+			if iLimit > listMaxLimit {
+				iLimit = listMaxLimit
+			}
+			query.limit = iLimit
+		}
+		query.after = opts.Get("after")
+	}
+	query.prefix = path
+	return query, nil
+}
+
+func (app *AthenaStoreApplication) doList(txn KVTxn, query *listQuery, login *loginEntry) (code uint32, codeDescr string, response interface{}) {
+	if login == nil {
+		return ErrorUnauth, fmt.Sprintf("Listing %s requires a valid user", query.prefix), nil
+	}
+	prefix, err := app.resolveSymlinkPath(txn, query.prefix)
+	if err != nil {
+		return ErrorUnexpected, err.Error(), nil
+	}
+	if prefix == "" && query.prefix != "" {
+		return ErrorOk, "", nil // prefix doesn't resolve to anything
+	}
+	if query.after != "" && !strings.HasPrefix(query.after, prefix) {
+		return ErrorBadFormat, fmt.Sprintf("Continuation %s is not within %s", query.after, prefix), nil
+	}
+
+	// keys in a tree are relative to the "directory" being listed
+	treeBase := prefix[:strings.LastIndex(prefix, "/")+1]
+	keys := []string{}
+	tree := make(map[string]interface{})
+	next := ""
+
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(prefix), KeysOnly: !query.tree})
+	defer iter.Close()
+	if query.after != "" {
+		iter.Seek([]byte(query.after))
+	} else {
+		iter.Rewind()
+	}
+	scanned := 0
+	lastKey := ""
+	for ; iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if scanned == listMaxScan {
+			next = lastKey
+			break
+		}
+		scanned++
+		lastKey = key
+		if key == query.after || !isMerkleKey(key) {
+			continue // already returned, or reserved for the application
+		}
+		canAccess, isAuthPath, err := app.canAccess(txn, false, login, key)
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
+		}
+		if !canAccess {
+			continue
+		}
+		if len(keys) == query.limit {
+			next = keys[len(keys)-1]
+			break
+		}
+		keys = append(keys, key)
+		if !query.tree {
+			continue
+		}
+
+		val, err := iter.Value()
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
+		}
+		gVal, err := fromBadgerType(val)
+		if err != nil {
+			return ErrorUnexpected, err.Error(), nil
+		}
+		if isAuthPath {
+			// account records are presented the same as if they had been queried directly
+			acctPath := strings.TrimSuffix(key, "/auth")
+			reqAcctData, _ := domainUserTypes.MatchFromPath(acctPath)
+			acctData, ok := gVal.(map[string]interface{})
+			if reqAcctData == nil || !ok {
+				continue
+			}
+			if err = reqAcctData.decodeAccountData(acctData, acctPath, false); err != nil {
+				return ErrorUnexpected, err.Error(), nil
+			}
+			gVal = reqAcctData.assembleQueryData()
+		}
+		storeDenseKey(tree, key[len(treeBase):], gVal)
+	}
+
+	result := make(map[string]interface{})
+	if query.tree {
+		result["tree"] = tree
+	} else {
+		result["keys"] = keys
+	}
+	if next != "" {
+		result["next"] = next
+	}
+	return ErrorOk, "", result
+}
@@ -0,0 +1,286 @@
+package app
+
+// Applies the operation-tagged entries of a transaction, which alter part of a stored document rather than
+// replacing it.  These appear in the list form of a transaction as {"op":..., "key":..., "path":..., "value":...},
+// where path is a JSON pointer (such as /profile/name) within the document stored at key.  Leaving out op replaces the
+// stored value as an ordinary entry would:
+//   merge     - merge the value (a map) into the document, with nulls removing entries (as in a JSON merge patch)
+//   set       - set the value at path, creating any missing maps on the way ("-" appends to an array)
+//   remove    - remove the entry at path
+//   append    - append the value to the array at path (creating it if missing)
+//   increment - add the value (a number) to the number at path (treating a missing entry as zero)
+//   delete    - delete the key
+//   deleteAccount - delete the account at key (such as user/bob) along with everything beneath it
+//   rotateKey - replace the key of the user account at key (see app-rotate.go)
+// Any of these may carry "if": {...} with a precondition on the current value of the key, see txCondition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	opMerge     = "merge"
+	opSet       = "set"
+	opRemove    = "remove"
+	opAppend    = "append"
+	opIncrement = "increment"
+	opDelete    = "delete"
+
+	opDeleteAccount = "deleteAccount"
+)
+
+var txOps = map[string]bool{opMerge: true, opSet: true, opRemove: true, opAppend: true, opIncrement: true, opDelete: true, opDeleteAccount: true, opRotateKey: true}
+
+// patchRemoved is returned by a patchFunc to remove the entry it was given
+type patchRemovedType struct{}
+
+var patchRemoved = &patchRemovedType{}
+
+type patchFunc func(old interface{}, exists bool) (interface{}, error)
+
+func parsePatchPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("Path %s must begin with a /", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for idx, token := range tokens {
+		tokens[idx] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// patchAt applies fn to the entry within doc identified by tokens, returning the altered document
+func patchAt(doc interface{}, exists bool, tokens []string, fn patchFunc) (interface{}, error) {
+	if len(tokens) == 0 {
+		return fn(doc, exists)
+	}
+	token := tokens[0]
+	switch typedDoc := doc.(type) {
+	case nil:
+		if exists {
+			return nil, fmt.Errorf("Cannot find %s within a null", token)
+		}
+		child, err := patchAt(nil, false, tokens[1:], fn)
+		if err != nil || child == patchRemoved {
+			return nil, err
+		}
+		return map[string]interface{}{token: child}, nil
+	case map[string]interface{}:
+		child, childExists := typedDoc[token]
+		child, err := patchAt(child, childExists, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		if child == patchRemoved {
+			delete(typedDoc, token)
+		} else {
+			typedDoc[token] = child
+		}
+		return typedDoc, nil
+	case []interface{}:
+		idx := len(typedDoc)
+		if token != "-" {
+			var err error
+			idx, err = strconv.Atoi(token)
+			if err != nil || idx < 0 || idx > len(typedDoc) {
+				return nil, fmt.Errorf("Array index %s is out of range", token)
+			}
+		}
+		if idx == len(typedDoc) {
+			// one past the end, we can only be adding something here
+			child, err := patchAt(nil, false, tokens[1:], fn)
+			if err != nil || child == patchRemoved {
+				return nil, err
+			}
+			return append(typedDoc, child), nil
+		}
+		child, err := patchAt(typedDoc[idx], true, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		if child == patchRemoved {
+			return append(typedDoc[:idx], typedDoc[idx+1:]...), nil
+		}
+		typedDoc[idx] = child
+		return typedDoc, nil
+	default:
+		return nil, fmt.Errorf("Cannot find %s within a scalar", token)
+	}
+}
+
+// mergeValue merges a patch into a document following the rules of a JSON merge patch
+func mergeValue(doc interface{}, patch interface{}) interface{} {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docMap, ok := doc.(map[string]interface{})
+	if !ok {
+		docMap = make(map[string]interface{})
+	}
+	for key, val := range patchMap {
+		if val == nil {
+			delete(docMap, key)
+		} else {
+			docMap[key] = mergeValue(docMap[key], val)
+		}
+	}
+	return docMap
+}
+
+// addNumbers adds two numbers, keeping the result an integer if both of them are
+func addNumbers(a interface{}, b interface{}) (interface{}, error) {
+	aInt, aIsInt := NumberToInt64(a)
+	bInt, bIsInt := NumberToInt64(b)
+	if aIsInt && bIsInt {
+		sum := aInt + bInt
+		if (sum > aInt) == (bInt > 0) {
+			return sum, nil
+		}
+	}
+	aFloat, aOk := numberToFloat64(a)
+	bFloat, bOk := numberToFloat64(b)
+	if !aOk || !bOk {
+		return nil, errors.New("Increment requires numeric values")
+	}
+	sum := aFloat + bFloat
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return nil, errors.New("Increment overflowed")
+	}
+	return sum, nil
+}
+
+func numberToFloat64(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	if i, ok := NumberToInt64(val); ok {
+		return float64(i), true
+	}
+	if u, ok := NumberToUint64(val); ok {
+		return float64(u), true
+	}
+	return 0, false
+}
+
+func unpackTxOp(opEntry map[string]interface{}) (*keyValue, error) {
+	entry := &keyValue{value: opEntry["value"]}
+	var ok bool
+	if op, hasOp := opEntry["op"]; hasOp {
+		if entry.op, ok = op.(string); !ok || !txOps[entry.op] {
+			return nil, fmt.Errorf("Transaction operation %v is not recognized", op)
+		}
+	}
+	if entry.key, ok = opEntry["key"].(string); !ok {
+		return nil, errors.New("Transaction operation requires a string key")
+	}
+	if path, ok := opEntry["path"]; ok {
+		if entry.path, ok = path.(string); !ok {
+			return nil, errors.New("Transaction operation path must be a string")
+		}
+	}
+	if cond, ok := opEntry["if"]; ok {
+		condMap, ok := cond.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Transaction precondition must be a map")
+		}
+		var err error
+		if entry.cond, err = unpackTxCondition(condMap); err != nil {
+			return nil, err
+		}
+	}
+	for key := range opEntry {
+		if key != "op" && key != "key" && key != "path" && key != "value" && key != "if" {
+			return nil, fmt.Errorf("Transaction operation has unexpected field %s", key)
+		}
+	}
+	if (entry.op == "" || entry.op == opDelete || entry.op == opDeleteAccount || entry.op == opRotateKey) && entry.path != "" {
+		return nil, fmt.Errorf("Transaction entry for %s cannot have a path", entry.key)
+	}
+	if _, err := parsePatchPath(entry.path); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// applyTxOp computes the new value of a key from an operation-tagged transaction entry, returning nil if the key is to
+// be deleted
+func applyTxOp(txn KVTxn, key string, entry keyValue) (interface{}, error) {
+	tokens, err := parsePatchPath(entry.path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := GetBadgerVal(txn, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var fn patchFunc
+	switch entry.op {
+	case opMerge:
+		if _, ok := entry.value.(map[string]interface{}); !ok {
+			return nil, errors.New("Merge requires a map value")
+		}
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			return mergeValue(old, entry.value), nil
+		}
+	case opSet:
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			return entry.value, nil
+		}
+	case opRemove:
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			if !exists {
+				return nil, fmt.Errorf("Nothing to remove at %s%s", key, entry.path)
+			}
+			return patchRemoved, nil
+		}
+	case opAppend:
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			if !exists || old == nil {
+				return []interface{}{entry.value}, nil
+			}
+			arr, ok := old.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Cannot append to non-array at %s%s", key, entry.path)
+			}
+			return append(arr, entry.value), nil
+		}
+	case opIncrement:
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			if !exists || old == nil {
+				old = int64(0)
+			}
+			return addNumbers(old, entry.value)
+		}
+	case opDelete:
+		fn = func(old interface{}, exists bool) (interface{}, error) {
+			return patchRemoved, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unrecognized operation %s", entry.op)
+	}
+
+	result, err := patchAt(doc, doc != nil, tokens, fn)
+	if err != nil {
+		return nil, err
+	}
+	if result == patchRemoved {
+		return nil, nil
+	}
+	return result, nil
+}
@@ -0,0 +1,150 @@
+package app
+
+// Handles replacing the key of a user account.  Every login and domain beneath the account carries a signature by
+// the user's key, so these must all be re-signed by the new key within the same transaction:
+//   {"op": "rotateKey", "key": "user/bob", "value": {
+//     "pubKey": <new key>,
+//     "proof": <signature by the new key of rotateKeyMessage, showing that it is held by the user>,
+//     "children": {"user/bob/login/phone": <signature by the new key, as found in its "sign">, ...}}}
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const opRotateKey = "rotateKey"
+
+var rotateChildPat = regexp.MustCompile("^(user/[^/]+/(login|domain)/[^/]+)/auth$")
+
+type rotateKeyRequest struct {
+	pubKey   []byte
+	proof    []byte
+	children map[string][]byte // child account path -> new parent signature
+}
+
+// RotateKeyMessage returns the message that the new key must sign to show that it is held by the account
+func RotateKeyMessage(acctPath string, oldPubKey []byte, newPubKey []byte) []byte {
+	return []byte(fmt.Sprintf("rotate:%s:%s:%s", acctPath,
+		base64.RawURLEncoding.EncodeToString(oldPubKey),
+		base64.RawURLEncoding.EncodeToString(newPubKey)))
+}
+
+func decodeBase64Field(fields map[string]interface{}, name string) ([]byte, error) {
+	strVal, ok := fields[name].(string)
+	if !ok {
+		return nil, fmt.Errorf("Key rotation requires a string %s", name)
+	}
+	return base64.RawURLEncoding.DecodeString(strVal)
+}
+
+func unpackRotateKey(value interface{}) (*rotateKeyRequest, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Key rotation requires a map value")
+	}
+	req := &rotateKeyRequest{children: make(map[string][]byte)}
+	var err error
+	if req.pubKey, err = decodeBase64Field(fields, "pubKey"); err != nil {
+		return nil, err
+	}
+	if len(req.pubKey) != ed25519.PublicKeySize {
+		return nil, errors.New("Key rotation has an invalid pubKey")
+	}
+	if req.proof, err = decodeBase64Field(fields, "proof"); err != nil {
+		return nil, err
+	}
+	if gChildren, ok := fields["children"]; ok {
+		children, ok := gChildren.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Key rotation children must be a map")
+		}
+		for path := range children {
+			if req.children[path], err = decodeBase64Field(children, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return req, nil
+}
+
+// canRotateKey checks that login may replace the key of the account at acctPath: only root or the user itself
+func canRotateKey(login *loginEntry, acctPath string) (code uint32, codeDescr string) {
+	acct, _ := domainUserTypes.MatchFromPath(acctPath)
+	if acct == nil || acct.Type != userUserTypeConfig {
+		return ErrorBadFormat, fmt.Sprintf("%s is not a user account", acctPath)
+	}
+	if login == nil {
+		return ErrorUnknownUser, fmt.Sprintf("Rotating the key of %s requires a valid user", acctPath)
+	}
+	if login.Type != rootUserTypeConfig && login.path() != acctPath {
+		return ErrorUnauth, fmt.Sprintf("Not authorized to rotate the key of %s", acctPath)
+	}
+	return 0, ""
+}
+
+// rotateKey replaces the key of a user account, re-signing all of its children
+func (app *AthenaStoreApplication) rotateKey(txn KVTxn, acctPath string, value interface{}) (code uint32, codeDescr string) {
+	req, err := unpackRotateKey(value)
+	if err != nil {
+		return ErrorBadFormat, err.Error()
+	}
+
+	acct, _ := domainUserTypes.MatchFromPath(acctPath)
+	err = acct.queryAccountData(txn, acctPath, acctPath)
+	if err != nil {
+		return ErrorNotFound, err.Error()
+	}
+	if acct.isMultiSig() {
+		return ErrorBadFormat, fmt.Sprintf("%s is a multi-signature account, change its pubKeys instead", acctPath)
+	}
+	if bytes.Equal(acct.Pubkey, req.pubKey) {
+		return ErrorBadFormat, "Key rotation does not change the key"
+	}
+	if !verifySignature(req.pubKey, RotateKeyMessage(acctPath, acct.Pubkey, req.pubKey), req.proof) {
+		return ErrorBadFormat, "Key rotation proof was not signed by the new key"
+	}
+
+	// find the children that need to be re-signed, and make sure we've been given a signature for each of them
+	var childPaths []string
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(acctPath + "/"), KeysOnly: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if matches := rotateChildPat.FindStringSubmatch(string(iter.Key())); matches != nil {
+			childPaths = append(childPaths, matches[1])
+		}
+	}
+	iter.Close()
+	if len(childPaths) != len(req.children) {
+		return ErrorBadFormat, fmt.Sprintf("Key rotation must re-sign all %d children of %s", len(childPaths), acctPath)
+	}
+
+	for _, childPath := range childPaths {
+		sign, ok := req.children[childPath]
+		if !ok {
+			return ErrorBadFormat, fmt.Sprintf("Key rotation did not re-sign %s", childPath)
+		}
+		child, _ := domainUserTypes.MatchFromPath(childPath)
+		err = child.queryAccountData(txn, childPath, acctPath)
+		if err != nil {
+			return ErrorUnexpected, err.Error()
+		}
+		if !verifySignature(req.pubKey, parentSignMessage(child), sign) {
+			return ErrorBadFormat, fmt.Sprintf("Key rotation signature for %s was not signed by the new key", childPath)
+		}
+		child.ParentSign = sign
+		err = app.setKey(txn, childPath+"/auth", child.assembleAccountData())
+		if err != nil {
+			return ErrorUnexpected, err.Error()
+		}
+	}
+
+	acct.Pubkey = req.pubKey
+	err = app.setKey(txn, acctPath+"/auth", acct.assembleAccountData())
+	if err != nil {
+		return ErrorUnexpected, err.Error()
+	}
+	return 0, ""
+}
@@ -1,7 +1,14 @@
 package app
 
-// Manages the SymLink maps -- either the hardcoded pubkey symlinks or later chain-defined attribute-based symlinks
+// Manages the SymLink maps -- either the hardcoded pubkey symlinks or the chain-defined attribute-based symlinks
 // All updates to the store pass through here in order to determine whether a symlink needs to be adjusted with the change
+//
+// Attribute-based symlinks are defined at config/symlinks, a list of maps:
+//   path - regex identifying the source keys, whose first grouping is the destination of the symlink
+//   attr - attribute of the source value holding the name of the symlink
+//   dest - prefix the symlink is created under (the symlink itself being dest + the attribute)
+// As with the permission table, changes take effect from the following block.  Adding a definition queues a job
+// that creates the symlinks for existing data, a limited number of keys per block
 
 import (
 	"bytes"
@@ -10,8 +17,6 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
-
-	"github.com/dgraph-io/badger"
 )
 
 type pubkeySymLinkMapEntry struct {
@@ -25,35 +30,68 @@ type symLinkMapEntry struct {
 	DestPrefix string         // where the symlink is created
 }
 
+type undoEntry struct {
+	key   string
+	value []byte // previous (encoded) value, nil if the key did not exist
+}
+
 var pubkeySymLinkPaths = []pubkeySymLinkMapEntry{
 	{regexp.MustCompile("^(config/rootUser)/auth$"), "keyMap/"},
 	{regexp.MustCompile("^(user/[^/]+)/auth$"), "keyMap/"},
 	{regexp.MustCompile("^(user/[^/]+/login/[^/]+)/auth$"), "keyMap/"},
-	{regexp.MustCompile("^(user/[^/]+/domain/[^/]+)/auth$"), "keyMap/"},
+	{regexp.MustCompile("^(group/[^/]+)/auth$"), "keyMap/"},
+	{regexp.MustCompile("^((?:user|group)/[^/]+/domain/[^/]+)/auth$"), "keyMap/"},
 }
 
-var symLinkPaths = []symLinkMapEntry{
+// defaultSymLinkPaths are the attribute-based symlinks of a chain that has not stored any of its own
+var defaultSymLinkPaths = []symLinkMapEntry{
 	{regexp.MustCompile("^(user/[^/]+)/email$"), "hash", "users/email/"},
 }
 
-func (app *AthenaStoreApplication) setKey(txn *badger.Txn, path string, value interface{}) error {
+func (app *AthenaStoreApplication) setKey(txn KVTxn, path string, value interface{}) error {
 	// are we matching any of our pubkey symlink paths?
 	for _, typ := range pubkeySymLinkPaths {
 		matches := typ.PathPat.FindStringSubmatch(path)
 		if matches != nil {
-			handlePubkeySymlinkChange(txn, path, matches[1], typ.DestPrefix, value)
+			err := app.handlePubkeySymlinkChange(txn, path, matches[1], typ.DestPrefix, value)
+			if err != nil {
+				return err
+			}
+			err = app.handleExpiryChange(txn, path, value)
+			if err != nil {
+				return err
+			}
+			err = app.handleNonceChange(txn, path, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if groupMemberPat.MatchString(path) {
+		err := app.handleMemberChange(txn, path, value)
+		if err != nil {
+			return err
 		}
 	}
-	for _, typ := range symLinkPaths {
+	if grantPat.MatchString(path) {
+		err := app.handleGrantChange(txn, path, value)
+		if err != nil {
+			return err
+		}
+	}
+	for _, typ := range app.symlinks {
 		matches := typ.PathPat.FindStringSubmatch(path)
 		if matches != nil {
-			handleSymlinkChange(txn, path, matches[1], typ.SourceAttr, typ.DestPrefix, value)
+			err := app.handleSymlinkChange(txn, path, matches[1], typ.SourceAttr, typ.DestPrefix, value)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// delete the value if requested
 	if value == nil {
-		return txn.Delete([]byte(path))
+		return app.storeRaw(txn, path, nil)
 	}
 
 	// otherwise convert the value to a binary and write it out
@@ -61,48 +99,115 @@ func (app *AthenaStoreApplication) setKey(txn *badger.Txn, path string, value in
 	if err != nil {
 		return err
 	}
+	return app.storeRaw(txn, path, encData)
+}
+
+// storeRaw writes (or deletes, if encData is nil) a key in the store, noting the change for the merkle tree
+// and (if we are inside a transaction) what the key previously held so the transaction can be rolled back
+func (app *AthenaStoreApplication) storeRaw(txn KVTxn, path string, encData []byte) error {
+	undoLog := app.undoLogOf(txn)
+	if isMerkleKey(path) && txn != app.checkState.txn {
+		// the check state is never committed, it has no part in the merkle tree
+		app.dirtyKeys[path] = struct{}{}
+	}
+	if *undoLog != nil {
+		oldData, err := getBadgerRaw(txn, path)
+		if err != nil {
+			return err
+		}
+		*undoLog = append(*undoLog, undoEntry{key: path, value: oldData})
+	}
+	if encData == nil {
+		return txn.Delete([]byte(path))
+	}
 	return txn.Set([]byte(path), encData)
 }
 
-func resolveSymlinkPath(txn *badger.Txn, path string) (string, error) {
-	segments := strings.Split(path, ":")
-	for len(segments) > 1 {
-		firstSeg := segments[0]
+// undoLogOf returns the undo log recording the changes made to txn, which is kept apart for the check state
+func (app *AthenaStoreApplication) undoLogOf(txn KVTxn) *[]undoEntry {
+	if txn == app.checkState.txn {
+		return &app.checkState.undoLog
+	}
+	return &app.undoLog
+}
+
+// beginUndo starts recording the changes made by a transaction to txn
+func (app *AthenaStoreApplication) beginUndo(txn KVTxn) {
+	*app.undoLogOf(txn) = make([]undoEntry, 0)
+}
 
-		// we have a symlink requested for this, we'll figure out what it is
-		for _, typ := range pubkeySymLinkPaths {
-			if len(typ.DestPrefix) > len(firstSeg) && typ.DestPrefix == typ.DestPrefix[:len(firstSeg)] {
-				symDest, err := resolveSymlinkSeg(txn, firstSeg)
-				if err != nil {
-					return "", err
-				}
-				if symDest == "" {
-					return "", nil // key doesn't resolve to anything
-				}
-				newSegment := fmt.Sprintf("%s/%s", symDest, segments[1])
-				segments = append(strings.Split(newSegment, ":"), segments[2:]...)
-				continue
-			}
+// endUndo stops recording changes, reverting everything recorded since beginUndo if requested
+func (app *AthenaStoreApplication) endUndo(txn KVTxn, rollback bool) error {
+	undoLog := *app.undoLogOf(txn)
+	*app.undoLogOf(txn) = nil
+	if !rollback {
+		return nil
+	}
+	for idx := len(undoLog) - 1; idx >= 0; idx-- {
+		entry := undoLog[idx]
+		var err error
+		if entry.value == nil {
+			err = txn.Delete([]byte(entry.key))
+		} else {
+			err = txn.Set([]byte(entry.key), entry.value)
 		}
-		for _, typ := range symLinkPaths {
-			if len(typ.DestPrefix) > len(firstSeg) && typ.DestPrefix == typ.DestPrefix[:len(firstSeg)] {
-				symDest, err := resolveSymlinkSeg(txn, firstSeg)
-				if err != nil {
-					return "", err
-				}
-				if symDest == "" {
-					return "", nil // key doesn't resolve to anything
-				}
-				newSegment := fmt.Sprintf("%s/%s", symDest, segments[1])
-				segments = append(strings.Split(newSegment, ":"), segments[2:]...)
-				continue
-			}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxSymlinkDepth limits how many symlinks may be followed while resolving a single path
+const maxSymlinkDepth = 8
+
+// resolveSymlinkPath resolves a path such as keyMap/<pubkey>:store, where everything before a colon names a symlink
+// to be replaced by its destination.  An empty path is returned if a symlink does not exist
+func (app *AthenaStoreApplication) resolveSymlinkPath(txn KVTxn, path string) (string, error) {
+	fullKey, _, err := app.resolveSymlinkLinks(txn, path)
+	return fullKey, err
+}
+
+// resolveSymlinkLinks resolves a path as resolveSymlinkPath does, also returning the symlinks it read along the way
+// (the last of which is the one that did not exist, if the path could not be resolved)
+func (app *AthenaStoreApplication) resolveSymlinkLinks(txn KVTxn, path string) (string, []string, error) {
+	var links []string
+	segments := strings.SplitN(path, ":", 2)
+	for depth := 0; len(segments) > 1; depth++ {
+		if depth == maxSymlinkDepth {
+			return "", nil, fmt.Errorf("Too many symlinks resolving %s", path)
+		}
+		if !app.isSymlinkPath(segments[0]) {
+			return "", nil, nil // not a location that holds symlinks
+		}
+		links = append(links, segments[0])
+		symDest, err := resolveSymlinkSeg(txn, segments[0])
+		if err != nil {
+			return "", nil, err
+		}
+		if symDest == "" {
+			return "", links, nil // key doesn't resolve to anything
+		}
+		segments = strings.SplitN(symDest+"/"+segments[1], ":", 2)
+	}
+	return segments[0], links, nil
+}
+
+func (app *AthenaStoreApplication) isSymlinkPath(path string) bool {
+	for _, typ := range pubkeySymLinkPaths {
+		if strings.HasPrefix(path, typ.DestPrefix) {
+			return true
+		}
+	}
+	for _, typ := range app.symlinks {
+		if strings.HasPrefix(path, typ.DestPrefix) {
+			return true
 		}
 	}
-	return segments[0], nil
+	return false
 }
 
-func resolveSymlinkSeg(txn *badger.Txn, path string) (string, error) {
+func resolveSymlinkSeg(txn KVTxn, path string) (string, error) {
 	linkPath, err := GetBadgerVal(txn, path)
 	if err != nil {
 		return "", err
@@ -117,7 +222,7 @@ func resolveSymlinkSeg(txn *badger.Txn, path string) (string, error) {
 	return strLinkPath, nil
 }
 
-func handlePubkeySymlinkChange(txn *badger.Txn, srcPath string, linkPath string, destPrefix string, value interface{}) error {
+func (app *AthenaStoreApplication) handlePubkeySymlinkChange(txn KVTxn, srcPath string, linkPath string, destPrefix string, value interface{}) error {
 
 	var newPubKey []byte
 	var oldPubKey []byte
@@ -156,7 +261,7 @@ func handlePubkeySymlinkChange(txn *badger.Txn, srcPath string, linkPath string,
 			if err == nil && gOldLinkPath != nil {
 				if oldLinkPath, ok := gOldLinkPath.(string); ok {
 					if oldLinkPath == linkPath {
-						err = txn.Delete([]byte(destPath))
+						err = app.storeRaw(txn, destPath, nil)
 						if err != nil {
 							return err
 						}
@@ -174,14 +279,14 @@ func handlePubkeySymlinkChange(txn *badger.Txn, srcPath string, linkPath string,
 			if err != nil {
 				return err
 			}
-			return txn.Set([]byte(destPath), encLinkPath)
+			return app.storeRaw(txn, destPath, encLinkPath)
 		}
 	}
 
 	return nil
 }
 
-func handleSymlinkChange(txn *badger.Txn, srcPath string, linkPath string, sourceAttr string, destPrefix string, value interface{}) error {
+func (app *AthenaStoreApplication) handleSymlinkChange(txn KVTxn, srcPath string, linkPath string, sourceAttr string, destPrefix string, value interface{}) error {
 
 	var newValue string
 	var oldValue string
@@ -220,7 +325,7 @@ func handleSymlinkChange(txn *badger.Txn, srcPath string, linkPath string, sourc
 			if err == nil && gOldLinkPath != nil {
 				if oldLinkPath, ok := gOldLinkPath.(string); ok {
 					if oldLinkPath == linkPath {
-						err = txn.Delete([]byte(destPath))
+						err = app.storeRaw(txn, destPath, nil)
 						if err != nil {
 							return err
 						}
@@ -238,7 +343,7 @@ func handleSymlinkChange(txn *badger.Txn, srcPath string, linkPath string, sourc
 			if err != nil {
 				return err
 			}
-			return txn.Set([]byte(destPath), encLinkPath)
+			return app.storeRaw(txn, destPath, encLinkPath)
 		}
 	}
 
@@ -4,13 +4,15 @@ package app
 
 import (
 	"crypto/ed25519"
-	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 
-	"github.com/dgraph-io/badger"
 	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/merkle"
 	tmlog "github.com/tendermint/tendermint/libs/log"
 )
 
@@ -18,25 +20,39 @@ type treeStateData struct {
 	lastBlockHeight int64
 	nextBlockHeight int64
 	lastBlockHash   []byte
+	chainID         string
 }
 
 // AthenaStoreApplication defines our blockchain application and its behavior
 type AthenaStoreApplication struct {
-	db               *badger.DB
+	db               KVStore
 	logger           tmlog.Logger
-	currentBatch     *badger.Txn
+	currentBatch     KVTxn
 	treeState        treeStateData
+	dirtyKeys        map[string]struct{} // keys changed since the merkle tree was last updated
+	undoLog          []undoEntry         // changes made by the current transaction, if it may need to be rolled back
+	checkState       checkStateData      // state that CheckTx validates transactions against
+	snapshots        *snapshotStore      // where state-sync snapshots are kept (nil if we take none)
+	restore          *snapshotRestore    // snapshot being restored by state sync, if any
+	permissions      []permissionRule    // permission table in effect for the current block
+	symlinks         []symLinkMapEntry   // attribute-based symlinks in effect for the current block
+	config           AppConfig
 	singleBlockEvent chan<- struct{}
 }
 
 type keyValue struct {
 	key   string
 	value interface{}
+	op    string       // operation to apply to the existing value (empty to replace it)
+	path  string       // location within the existing value that op applies to
+	cond  *txCondition // precondition that must hold before this entry is applied
 }
 
 type athenaTx struct {
-	Pkey ed25519.PublicKey
-	Msg  []keyValue
+	Pkey     ed25519.PublicKey
+	MultiSig *multiSigAuth // set instead of Pkey if signed by the keys of a multi-signature account
+	Nonce    int64         // must match the nonce of the signing account
+	Msg      []keyValue
 }
 
 const (
@@ -56,68 +72,147 @@ const (
 	ErrorBadFormat
 	// ErrorNotFound has a request depending on a nonexistent path
 	ErrorNotFound
+	// ErrorBadNonce the transaction nonce does not match the one expected for this account
+	ErrorBadNonce
+	// ErrorPrecondition the current value of a key does not satisfy the precondition of the transaction
+	ErrorPrecondition
 )
 
+// txHeaderLength is the length of the pubkey + signature + nonce that prefix every transaction
+const txHeaderLength = ed25519.PublicKeySize + ed25519.SignatureSize + 8
+
 var _ abcitypes.Application = (*AthenaStoreApplication)(nil)
 
 // NewAthenaStoreApplication create a new instance of AthenaStoreApplication
-func NewAthenaStoreApplication(db *badger.DB, logger tmlog.Logger) *AthenaStoreApplication {
-	app := &AthenaStoreApplication{db: db, logger: logger}
-	app.init()
+func NewAthenaStoreApplication(db KVStore, config AppConfig, logger tmlog.Logger) *AthenaStoreApplication {
+	app := &AthenaStoreApplication{
+		db:          db,
+		logger:      logger,
+		config:      config,
+		dirtyKeys:   make(map[string]struct{}),
+		permissions: defaultPermissionRules(),
+		symlinks:    defaultSymLinkPaths,
+	}
+	if db != nil {
+		app.init()
+	}
 	return app
 }
 
 // InitChain Called once upon genesis
 func (app *AthenaStoreApplication) InitChain(req abcitypes.RequestInitChain) abcitypes.ResponseInitChain {
-	// create the root user
-	pubb, pvk, _ := ed25519.GenerateKey(nil)
-	err := app.db.Update(func(txn *badger.Txn) error {
-		err := app.createRootUser(txn, pubb)
-		if err != nil {
-			return err
-		}
+	app.treeState.chainID = req.ChainId
 
-		return nil
-	})
+	// create the root user and anything else declared in the genesis file
+	state, err := decodeGenesisState(req.AppStateBytes)
 	if err != nil {
-		app.logger.Error("Unexpected trying to initialize the chain: " + err.Error())
+		panic("Unable to initialize the chain: " + err.Error())
 	}
-	app.logger.Error("root user successfully created with key: " + base64.RawURLEncoding.EncodeToString(pvk))
-	app.logger.Error("REMEMBER THIS KEY, it will not be recoverable again for this chain")
+	txn := app.db.NewTransactionAt(heightVersion(0), true)
+	defer txn.Discard()
+
+	// we may have stopped after a previous InitChain but before the first block, in which case it's already done
+	applied, err := genesisApplied(txn, req.ChainId, state)
+	if err != nil {
+		panic("Unable to initialize the chain: " + err.Error())
+	}
+	if applied {
+		app.logger.Info("genesis state has already been applied for chain " + req.ChainId)
+		return abcitypes.ResponseInitChain{}
+	}
+	err = app.applyGenesisState(txn, state)
+	if err == nil {
+		err = app.updateAppHash(txn)
+	}
+	if err == nil {
+		err = app.updateBlockState(txn)
+	}
+	if err == nil {
+		err = txn.CommitAt(heightVersion(0))
+	}
+	if err == nil {
+		err = app.loadPermissions()
+	}
+	if err == nil {
+		err = app.loadSymlinks()
+	}
+	if err != nil {
+		panic("Unable to initialize the chain: " + err.Error())
+	}
+	app.checkState.mtx.Lock()
+	app.resetCheckState()
+	app.checkState.mtx.Unlock()
+	app.logger.Info("root user created with " + state.describeRoot())
 
 	return abcitypes.ResponseInitChain{}
 }
 
-func (app *AthenaStoreApplication) loadTreeState() error {
-	// load our current status
-	return app.db.View(func(txn *badger.Txn) error {
-		val, err := GetBadgerVal(txn, "mesh/blockState")
-		if err != nil {
-			return err
+// heightVersion returns the store version that holds the state as of the end of the specified block (InitChain is height 0)
+func heightVersion(height int64) uint64 {
+	return uint64(height) + 1
+}
+
+func readBlockState(txn KVTxn) (*treeStateData, error) {
+	state := &treeStateData{}
+	val, err := GetBadgerVal(txn, "mesh/blockState")
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		// brand new KV store, use defaults
+		return state, nil
+	}
+	if iVal, ok := val.(map[string]interface{}); ok {
+		if lbh, ok := iVal["lastBlockHeight"]; ok {
+			if iLbh, ok := NumberToInt64(lbh); ok {
+				state.lastBlockHeight = iLbh
+			} else {
+				return nil, fmt.Errorf("Unexpected lastBlockHeight querying the tree state: %v", lbh)
+			}
 		}
-		if val == nil {
-			// brand new KV store, use defaults
-			return nil
+		if lbh, ok := iVal["lastBlockHash"]; ok {
+			if bLbh, ok := lbh.([]byte); ok {
+				state.lastBlockHash = bLbh
+			} else {
+				return nil, fmt.Errorf("Unexpected lastBlockHash querying the tree state: %v", lbh)
+			}
 		}
-		if iVal, ok := val.(map[string]interface{}); ok {
-			if lbh, ok := iVal["lastBlockHeight"]; ok {
-				if iLbh, ok := NumberToInt64(lbh); ok {
-					app.treeState.lastBlockHeight = iLbh
-				} else {
-					return fmt.Errorf("Unexpected lastBlockHeight querying the tree state: %v", lbh)
-				}
+		if cid, ok := iVal["chainId"]; ok {
+			if sCid, ok := cid.(string); ok {
+				state.chainID = sCid
+			} else {
+				return nil, fmt.Errorf("Unexpected chainId querying the tree state: %v", cid)
 			}
-			if lbh, ok := iVal["lastBlockHash"]; ok {
-				if bLbh, ok := lbh.([]byte); ok {
-					app.treeState.lastBlockHash = bLbh
-				} else {
-					return fmt.Errorf("Unexpected lastBlockHash querying the tree state: %v", lbh)
-				}
+		}
+		return state, nil
+	}
+	return nil, fmt.Errorf("Unexpected value querying the tree state: %v", val)
+}
+
+func (app *AthenaStoreApplication) loadTreeState() error {
+	// load our current status
+	txn := app.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	state, err := readBlockState(txn)
+	if err != nil {
+		return err
+	}
+	app.treeState = *state
+	return nil
+}
+
+// pruneVersions permits badger to discard any versions of our data that are older than our retention window
+func (app *AthenaStoreApplication) pruneVersions() {
+	if app.config.RetainBlocks > 0 && app.treeState.lastBlockHeight > app.config.RetainBlocks {
+		discardHeight := app.treeState.lastBlockHeight - app.config.RetainBlocks
+		if app.snapshots != nil {
+			// a snapshot still being taken must be able to read the block it is of
+			if pinned := app.snapshots.pinnedHeight(); pinned > 0 && pinned < discardHeight {
+				discardHeight = pinned
 			}
-			return nil
 		}
-		return fmt.Errorf("Unexpected value querying the tree state: %v", val)
-	})
+		app.db.SetDiscardVersion(heightVersion(discardHeight))
+	}
 }
 
 func (app *AthenaStoreApplication) init() {
@@ -126,6 +221,23 @@ func (app *AthenaStoreApplication) init() {
 	if err != nil {
 		panic("Unexpected error on loading tree state: " + err.Error())
 	}
+	err = app.loadPermissions()
+	if err != nil {
+		panic("Unexpected error on loading the permission table: " + err.Error())
+	}
+	err = app.loadSymlinks()
+	if err != nil {
+		panic("Unexpected error on loading the symlink definitions: " + err.Error())
+	}
+	app.checkState.mtx.Lock()
+	app.resetCheckState()
+	app.checkState.mtx.Unlock()
+	app.pruneVersions()
+}
+
+// currentHeight returns the height of the block being executed (or the next one to be, if we are between blocks)
+func (app *AthenaStoreApplication) currentHeight() int64 {
+	return app.treeState.lastBlockHeight + 1
 }
 
 // Info Return information about the application state
@@ -141,38 +253,63 @@ func (app *AthenaStoreApplication) BeginBlock(req abcitypes.RequestBeginBlock) a
 	if app.currentBatch != nil {
 		app.logger.Error("Unexpected: calling BeginBlock with an open transaction (transaction discarded)")
 	}
-	app.currentBatch = app.db.NewTransaction(true)
+	app.currentBatch = app.db.NewTransactionAt(heightVersion(app.treeState.lastBlockHeight), true)
 	return abcitypes.ResponseBeginBlock{}
 }
 
 func (app *AthenaStoreApplication) unpackTx(tx []byte) (*athenaTx, uint32, string) {
 	dec := athenaTx{}
-	if len(tx) < 96 {
+	if isMultiSigEnvelope(tx) {
+		multiSig, nonceAndBody, code, info := unpackMultiSig(tx, func(acctPath string, rest []byte) []byte {
+			return MultiSigTxSignBytes(app.treeState.chainID, acctPath, rest)
+		})
+		if code != 0 {
+			return nil, code, info
+		}
+		dec.MultiSig = multiSig
+		return unpackTxBody(&dec, nonceAndBody)
+	}
+	if len(tx) < txHeaderLength {
 		return nil, ErrorTxTooShort, "Tx too short"
 	}
-	dec.Pkey = tx[0:32]
-	sign := tx[32:96]
-
-	body := tx[96:]
-	if !ed25519.Verify(dec.Pkey, body, sign) {
+	dec.Pkey = tx[0:ed25519.PublicKeySize]
+	sign := tx[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	nonceAndBody := tx[ed25519.PublicKeySize+ed25519.SignatureSize:]
+	if !ed25519.Verify(dec.Pkey, TxSignBytes(app.treeState.chainID, nonceAndBody), sign) {
 		return nil, ErrorTxBadSign, "Transaction signature invalid"
 	}
+	return unpackTxBody(&dec, nonceAndBody)
+}
+
+// unpackTxBody reads the nonce and body that follow the signature(s) of a transaction
+func unpackTxBody(dec *athenaTx, nonceAndBody []byte) (*athenaTx, uint32, string) {
+	if len(nonceAndBody) < 8 {
+		return nil, ErrorTxTooShort, "Tx too short"
+	}
+	dec.Nonce = int64(binary.BigEndian.Uint64(nonceAndBody[:8]))
+	if dec.Nonce < 0 {
+		return nil, ErrorBadNonce, "Transaction nonce out of range"
+	}
+	body := nonceAndBody[8:]
 
 	decoder := json.NewDecoder(strings.NewReader(string(body)))
 	decoder.UseNumber()
-	if err := decoder.Decode(&dec.Msg); err != nil {
-		return nil, ErrorBadFormat, err.Error()
-	}
 
 	var json interface{}
 	if err := decoder.Decode(&json); err != nil {
 		return nil, ErrorBadFormat, err.Error()
 	}
 	if mapMsg, ok := json.(map[string]interface{}); ok {
-		// passing in a {key:value} map is permitted, let's unroll this into a tuple list
-		arrMsg := make([]keyValue, 0)
-		for key, value := range mapMsg {
-			arrMsg = append(arrMsg, keyValue{key: key, value: value})
+		// passing in a {key:value} map is permitted, let's unroll this into a tuple list.
+		// Maps have no order of their own so we impose one, every node must apply these writes identically
+		keys := make([]string, 0, len(mapMsg))
+		for key := range mapMsg {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return canonicalKeyLess(keys[i], keys[j]) })
+		arrMsg := make([]keyValue, 0, len(keys))
+		for _, key := range keys {
+			arrMsg = append(arrMsg, keyValue{key: key, value: mapMsg[key]})
 		}
 		dec.Msg = arrMsg
 	} else if tupleMsg, ok := json.([]interface{}); ok {
@@ -188,8 +325,15 @@ func (app *AthenaStoreApplication) unpackTx(tx []byte) (*athenaTx, uint32, strin
 					return nil, ErrorBadFormat, "Transaction not in an expected format (found array with tuples, but first element must be a string)"
 				}
 				arrMsg = append(arrMsg, keyValue{key: key, value: tuple[1]})
+			} else if opEntry, ok := genTuple.(map[string]interface{}); ok {
+				// an operation-tagged entry that alters part of the existing value
+				entry, err := unpackTxOp(opEntry)
+				if err != nil {
+					return nil, ErrorBadFormat, err.Error()
+				}
+				arrMsg = append(arrMsg, *entry)
 			} else {
-				return nil, ErrorBadFormat, "Transaction not in an expected format (found array but elements must be tuples)"
+				return nil, ErrorBadFormat, "Transaction not in an expected format (found array but elements must be tuples or operations)"
 			}
 		}
 		dec.Msg = arrMsg
@@ -197,24 +341,56 @@ func (app *AthenaStoreApplication) unpackTx(tx []byte) (*athenaTx, uint32, strin
 		return nil, ErrorBadFormat, "Transaction not in an expected format"
 	}
 
-	return &dec, ErrorOk, ""
+	return dec, ErrorOk, ""
+}
+
+// TxSignBytes returns the message signed by a transaction: the chain ID (so the transaction cannot be replayed on
+// another chain) followed by the nonce and body of the transaction
+func TxSignBytes(chainID string, nonceAndBody []byte) []byte {
+	return append(append([]byte(chainID), 0), nonceAndBody...)
 }
 
-func (app *AthenaStoreApplication) unpackQuery(data []byte, path string) (ed25519.PublicKey, uint32, string) {
+// canonicalKeyLess orders the keys of a map-form transaction: shallower paths first (so an account is written before
+// anything beneath it), then account records before their siblings, then by byte order
+func canonicalKeyLess(a string, b string) bool {
+	aDepth, bDepth := strings.Count(a, "/"), strings.Count(b, "/")
+	if aDepth != bDepth {
+		return aDepth < bDepth
+	}
+	aAuth, bAuth := strings.HasSuffix(a, "/auth"), strings.HasSuffix(b, "/auth")
+	if aAuth != bAuth {
+		return aAuth
+	}
+	return a < b
+}
+
+func (app *AthenaStoreApplication) unpackQuery(data []byte, path string) (ed25519.PublicKey, *multiSigAuth, uint32, string) {
 	if data == nil {
-		return nil, ErrorOk, "" // no authentication
+		return nil, nil, ErrorOk, "" // no authentication
+	}
+	if isMultiSigEnvelope(data) {
+		multiSig, rest, code, info := unpackMultiSig(data, func(acctPath string, rest []byte) []byte {
+			return MultiSigQuerySignBytes(app.treeState.chainID, acctPath, path)
+		})
+		if code != 0 {
+			return nil, nil, code, info
+		}
+		if len(rest) != 0 {
+			return nil, nil, ErrorBadFormat, "Data is wrong length"
+		}
+		return nil, multiSig, ErrorOk, ""
 	}
 	if len(data) != 96 {
-		return nil, ErrorTxTooShort, "Data is wrong length"
+		return nil, nil, ErrorTxTooShort, "Data is wrong length"
 	}
 	pubKey := data[0:32]
 	sign := data[32:96]
 
 	if !ed25519.Verify(pubKey, []byte(path), sign) {
-		return nil, ErrorTxBadSign, "Transaction signature invalid"
+		return nil, nil, ErrorTxBadSign, "Transaction signature invalid"
 	}
 
-	return pubKey, ErrorOk, ""
+	return pubKey, nil, ErrorOk, ""
 }
 
 // SetOption Set non-consensus critical application specific options
@@ -228,20 +404,12 @@ func (app *AthenaStoreApplication) DeliverTx(req abcitypes.RequestDeliverTx) abc
 	if code != 0 {
 		return abcitypes.ResponseDeliverTx{Code: code, Codespace: "athena", Info: info}
 	}
-	user, err := app.isAuth(app.currentBatch, tx.Pkey)
-	if err != nil {
-		return abcitypes.ResponseDeliverTx{Code: ErrorUnexpected, Codespace: "athena", Info: err.Error()}
-	}
-	code, info = app.isValid(tx, user)
-	if code != 0 {
-		return abcitypes.ResponseDeliverTx{Code: code, Codespace: "athena", Info: info}
-	}
-	code, info = app.executeTx(tx, user)
+	code, info, events := app.runTx(app.currentBatch, tx)
 	if code != 0 {
 		return abcitypes.ResponseDeliverTx{Code: code, Codespace: "athena", Info: info}
 	}
 
-	return abcitypes.ResponseDeliverTx{Code: 0}
+	return abcitypes.ResponseDeliverTx{Code: 0, Events: events}
 }
 
 // CheckTx (Optional) Guardian of the mempool: every node runs CheckTx before letting a transaction into its local mempool
@@ -250,20 +418,64 @@ func (app *AthenaStoreApplication) CheckTx(req abcitypes.RequestCheckTx) abcityp
 	if code != 0 {
 		return abcitypes.ResponseCheckTx{Code: code, Codespace: "athena", Info: info}
 	}
-	user, err := app.isAuth(app.currentBatch, tx.Pkey)
-	if err != nil {
-		return abcitypes.ResponseCheckTx{Code: ErrorUnexpected, Codespace: "athena", Info: err.Error()}
+
+	// run it against the check state, so that the transactions following it in the mempool can see what it did
+	app.checkState.mtx.Lock()
+	defer app.checkState.mtx.Unlock()
+	if app.checkState.txn == nil {
+		return abcitypes.ResponseCheckTx{Code: ErrorUnexpected, Codespace: "athena", Info: errNoCheckState.Error()}
 	}
-	code, info = app.isValid(tx, user)
+	code, info, _ = app.runTx(app.checkState.txn, tx)
 	if code != 0 {
 		return abcitypes.ResponseCheckTx{Code: code, Codespace: "athena", Info: info}
 	}
 	return abcitypes.ResponseCheckTx{Code: 0}
 }
 
-func (app *AthenaStoreApplication) updateLastBlockHeight(txn *badger.Txn) error {
+// runTx authenticates and executes a transaction against txn, leaving txn untouched if it fails
+func (app *AthenaStoreApplication) runTx(txn KVTxn, tx *athenaTx) (code uint32, info string, events []abcitypes.Event) {
+	user, err := app.isAuth(txn, tx.Pkey, tx.MultiSig)
+	if err != nil {
+		return authErrorCode(err), err.Error(), nil
+	}
+	expected, err := expectedNonce(txn, user, tx.Pkey)
+	if err != nil {
+		return ErrorUnexpected, err.Error(), nil
+	}
+	if tx.Nonce != expected {
+		return ErrorBadNonce, fmt.Sprintf("Expected nonce %d but received %d", expected, tx.Nonce), nil
+	}
+	code, info = app.isValid(txn, tx, user)
+	if code != 0 {
+		return code, info, nil
+	}
+
+	// every write in this transaction must succeed or none of them may
+	app.beginUndo(txn)
+	code, info, events = app.executeTx(txn, tx, user)
+	if code == 0 {
+		err = app.bumpNonce(txn, tx)
+		if err != nil {
+			code, info = ErrorUnexpected, err.Error()
+		}
+	}
+	// if we could not put back what a failed transaction wrote then we cannot go on, the partial writes would be
+	// committed along with the block
+	err = app.endUndo(txn, code != 0)
+	if err != nil {
+		panic("Unable to roll back a failed transaction: " + err.Error())
+	}
+	if code != 0 {
+		return code, info, nil
+	}
+	return 0, "", events
+}
+
+func (app *AthenaStoreApplication) updateBlockState(txn KVTxn) error {
 	blockState := make(map[string]interface{})
 	blockState["lastBlockHeight"] = app.treeState.nextBlockHeight
+	blockState["lastBlockHash"] = app.treeState.lastBlockHash
+	blockState["chainId"] = app.treeState.chainID
 
 	encData, err := ToBadgerType(blockState)
 	if err != nil {
@@ -272,38 +484,100 @@ func (app *AthenaStoreApplication) updateLastBlockHeight(txn *badger.Txn) error
 	return txn.Set([]byte("mesh/blockState"), encData)
 }
 
-// Query Query for data from the application at current or past height
+// Query Query for data from the application at current or past height.  If a proof is requested then the response
+// Value holds the stored (binary) encoding of the resolved key rather than JSON so it can be checked against the proof.
+// The proof holds one op for each symlink followed and then one for the resolved key, the last of them naming Key
 func (app *AthenaStoreApplication) Query(req abcitypes.RequestQuery) abcitypes.ResponseQuery {
-	pubKey, code, info := app.unpackQuery(req.Data, req.Path)
+	pubKey, multiSig, code, info := app.unpackQuery(req.Data, req.Path)
 	if code != 0 {
 		return abcitypes.ResponseQuery{Code: code, Codespace: "athena", Info: info}
 	}
-	var response interface{}
-	err := app.db.View(func(txn *badger.Txn) error {
-		var user *loginEntry
+	height := req.Height
+	if height == 0 {
+		height = app.treeState.lastBlockHeight
+	}
+	if height > app.treeState.lastBlockHeight {
+		return abcitypes.ResponseQuery{Code: ErrorNotFound, Codespace: "athena", Info: fmt.Sprintf("Height %d has not yet been committed", height)}
+	}
+	if app.config.RetainBlocks > 0 && height < app.treeState.lastBlockHeight-app.config.RetainBlocks {
+		return abcitypes.ResponseQuery{Code: ErrorNotFound, Codespace: "athena", Info: fmt.Sprintf("Height %d is no longer retained", height)}
+	}
+
+	// we authenticate against the current state but read from the requested height
+	var user *loginEntry
+	if pubKey != nil || multiSig != nil {
 		var err error
-		if pubKey != nil {
-			user, err = app.isAuth(txn, pubKey)
+		authTxn := app.db.NewTransactionAt(heightVersion(app.treeState.lastBlockHeight), false)
+		user, err = app.isAuth(authTxn, pubKey, multiSig)
+		authTxn.Discard()
+		if err != nil {
+			return abcitypes.ResponseQuery{Code: authErrorCode(err), Codespace: "athena", Info: err.Error()}
+		}
+	}
+
+	var response interface{}
+	var provenKey string
+	var rawValue []byte
+	var proof *merkle.Proof
+	txn := app.db.NewTransactionAt(heightVersion(height), false)
+	defer txn.Discard()
+	err := func() error {
+		code, info, response = app.doQuery(txn, req.Path, user)
+		if code != 0 || !req.Prove {
+			return nil
+		}
+		if listQuery, _ := parseListQuery(req.Path); listQuery != nil {
+			code, info = ErrorBadFormat, "Proofs are not available for list queries"
+			return nil
+		}
+
+		// we've been permitted to see this key, prove whatever is stored there along with each symlink leading to it.
+		// An anonymous query only sees part of an account record, but its proof carries all of it (as does every node)
+		fullKey, links, err := app.resolveSymlinkLinks(txn, req.Path)
+		if err != nil {
+			return err
+		}
+		provenKeys := links
+		if fullKey != "" {
+			provenKeys = append(provenKeys, fullKey)
+			rawValue, err = getBadgerRaw(txn, fullKey)
 			if err != nil {
 				return err
 			}
 		}
-
-		code, info, response = app.doQuery(txn, req.Path, user)
+		if len(provenKeys) == 0 {
+			return nil
+		}
+		state, err := readBlockState(txn)
+		if err != nil {
+			return err
+		}
+		proof = &merkle.Proof{}
+		for _, key := range provenKeys {
+			keyProof, err := proveKey(txn, state.lastBlockHash, key)
+			if err != nil {
+				return err
+			}
+			proof.Ops = append(proof.Ops, keyProof.Ops...)
+		}
+		provenKey = provenKeys[len(provenKeys)-1]
 		return nil
-	})
+	}()
 	if err != nil {
 		return abcitypes.ResponseQuery{Code: ErrorUnexpected, Codespace: "athena", Info: err.Error()}
 	}
 	if code != 0 {
 		return abcitypes.ResponseQuery{Code: code, Codespace: "athena", Info: info}
 	}
+	if req.Prove {
+		return abcitypes.ResponseQuery{Code: 0, Key: []byte(provenKey), Value: rawValue, Proof: proof, Height: height}
+	}
 	jsonValue, err := json.Marshal(response)
 	if err != nil {
 		return abcitypes.ResponseQuery{Code: ErrorUnexpected, Codespace: "athena", Info: err.Error()}
 	}
 
-	return abcitypes.ResponseQuery{Code: 0, Value: jsonValue}
+	return abcitypes.ResponseQuery{Code: 0, Value: jsonValue, Height: height}
 }
 
 // EndBlock Signals the end of a block. Called after all transactions, prior to each Commit
@@ -314,17 +588,63 @@ func (app *AthenaStoreApplication) EndBlock(req abcitypes.RequestEndBlock) abcit
 
 // Commit Persist the application state. Later calls to Query can return proofs about the application state anchored in this Merkle root hash
 func (app *AthenaStoreApplication) Commit() abcitypes.ResponseCommit {
-	err := app.updateLastBlockHeight(app.currentBatch)
+	// CheckTx must wait until it can see the new block
+	app.checkState.mtx.Lock()
+	defer app.checkState.mtx.Unlock()
+
+	// the end-of-block jobs change state that every node must agree on, we cannot go on without them
+	err := app.expireAccounts(app.currentBatch, app.treeState.nextBlockHeight)
+	if err != nil {
+		panic("Unable to expire accounts: " + err.Error())
+	}
+	err = app.runSymlinkBackfill(app.currentBatch)
+	if err != nil {
+		panic("Unable to backfill symlinks: " + err.Error())
+	}
+	_, permissionsChanged := app.dirtyKeys[permissionsKey]
+	_, symlinksChanged := app.dirtyKeys[symlinksKey]
+	if symlinksChanged {
+		err = app.queueSymlinkBackfill(app.currentBatch)
+		if err != nil {
+			panic("Unable to queue symlink backfill: " + err.Error())
+		}
+	}
+	// if we cannot agree on the app hash then we cannot go on, committing anyway would leave us reporting a hash
+	// that does not match our state
+	err = app.updateAppHash(app.currentBatch)
+	if err != nil {
+		panic("Unable to update the merkle tree: " + err.Error())
+	}
+	err = app.updateBlockState(app.currentBatch)
 	if err != nil {
-		app.logger.Error("Unexpected trying to update block state: " + err.Error())
+		panic("Unable to update block state: " + err.Error())
 	}
 
-	app.currentBatch.Commit()
+	err = app.currentBatch.CommitAt(heightVersion(app.treeState.nextBlockHeight))
+	if err != nil {
+		panic("Unable to commit block state: " + err.Error())
+	}
 	app.currentBatch = nil
 	if app.treeState.nextBlockHeight != 0 {
 		app.treeState.lastBlockHeight = app.treeState.nextBlockHeight
 		app.treeState.nextBlockHeight = 0
 	}
+	if permissionsChanged {
+		// the new table takes effect from the next block
+		err = app.loadPermissions()
+		if err != nil {
+			app.logger.Error("Unexpected trying to load the permission table: " + err.Error())
+		}
+	}
+	if symlinksChanged {
+		err = app.loadSymlinks()
+		if err != nil {
+			app.logger.Error("Unexpected trying to load the symlink definitions: " + err.Error())
+		}
+	}
+	app.resetCheckState()
+	app.takeSnapshot()
+	app.pruneVersions()
 	if app.singleBlockEvent != nil {
 		close(app.singleBlockEvent)
 		app.singleBlockEvent = nil
@@ -334,5 +654,5 @@ func (app *AthenaStoreApplication) Commit() abcitypes.ResponseCommit {
 		close(FirstCycleComplete)
 		FirstCycleComplete = nil
 	}
-	return abcitypes.ResponseCommit{}
+	return abcitypes.ResponseCommit{Data: app.treeState.lastBlockHash}
 }
@@ -3,15 +3,15 @@ package app
 // Defines the encoding we use to convert a JSON-like "document" into a binary stream for the datastore
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/dgraph-io/badger"
 )
 
 const (
@@ -24,6 +24,8 @@ const (
 	typeMap         = 7
 )
 
+const canonicalNaN uint64 = 0x7FF8000000000001
+
 // NumberToUint64 attempts to convert numeric val to a uint64
 func NumberToUint64(val interface{}) (uint64, bool) {
 	switch v := val.(type) {
@@ -67,6 +69,9 @@ func NumberToInt64(val interface{}) (int64, bool) {
 		return int64(v), true
 	case uint:
 		return int64(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
 	}
 	return 0, false
 }
@@ -118,6 +123,11 @@ func NumberToInt(val interface{}) (int, bool) {
 	return 0, false
 }
 
+// DecodeValue converts a value in its stored encoding (such as the Value of a proven query) back into a document
+func DecodeValue(val []byte) (interface{}, error) {
+	return fromBadgerType(val)
+}
+
 func fromBadgerType(val []byte) (interface{}, error) {
 	if val == nil || len(val) == 0 {
 		return nil, errors.New("cannot interpret empty string")
@@ -134,28 +144,16 @@ func fromBadgerType(val []byte) (interface{}, error) {
 			// just assume this is a ulong that might exceed long limits, can't really do anything else
 			return binary.LittleEndian.Uint64(val[1:9]), nil
 		case 9, 8, 7, 6:
-			bits := val[1:]
-			if bits[len(bits)-1] >= 0x80 {
-				bits = append(bits, 0xff, 0xff, 0xff)[:8]
-			} else {
-				bits = append(bits, 0, 0, 0)[:8]
-			}
-			return int64(binary.LittleEndian.Uint64(bits)), nil
+			return int64(binary.LittleEndian.Uint64(signExtend(val[1:]))), nil
 		case 5, 4, 3, 2:
-			bits := val[1:]
-			if bits[len(bits)-1] >= 0x80 {
-				bits = append(bits, 0xff, 0xff, 0xff)[:8]
-			} else {
-				bits = append(bits, 0, 0, 0)[:8]
-			}
-			return int32(binary.LittleEndian.Uint32(bits)), nil
+			return int32(binary.LittleEndian.Uint32(signExtend(val[1:]))), nil
 		default:
 			return nil, errors.New("unexpected data length")
 		}
 	case typeFloat:
 		switch len(val) {
 		case 5:
-			return math.Float32frombits(binary.LittleEndian.Uint32(val[1:9])), nil
+			return math.Float32frombits(binary.LittleEndian.Uint32(val[1:5])), nil
 		case 9:
 			return math.Float64frombits(binary.LittleEndian.Uint64(val[1:9])), nil
 		default:
@@ -208,12 +206,26 @@ func fromBadgerType(val []byte) (interface{}, error) {
 	}
 }
 
+// signExtend copies a truncated little-endian integer into a full 8-byte buffer
+// (we cannot append to it in place, as it is likely a slice from the middle of a larger value)
+func signExtend(bits []byte) []byte {
+	result := make([]byte, 8)
+	if bits[len(bits)-1] >= 0x80 {
+		for idx := range result {
+			result[idx] = 0xff
+		}
+	}
+	copy(result, bits)
+	return result
+}
+
 func toBadgerTypeUint(val uint64) []byte {
+	if val <= math.MaxInt64 {
+		// anything that fits in a signed long is stored as one, so equal values always have the same encoding
+		return toBadgerTypeInt(int64(val))
+	}
 	bits := make([]byte, 8)
 	binary.LittleEndian.PutUint64(bits, val)
-	for len(bits) > 1 && bits[len(bits)-1] == 0 && bits[len(bits)-2] < 0x80 {
-		bits = bits[:len(bits)-1]
-	}
 	return append(append([]byte{typeInt}, bits...), 0)
 }
 
@@ -226,7 +238,22 @@ func toBadgerTypeInt(val int64) []byte {
 	return append([]byte{typeInt}, bits...)
 }
 
-// ToBadgerType convert the specified scalar into something stored in a Badger KV store
+func toBadgerTypeFloat(val float64) []byte {
+	// floats are always stored as doubles, with a single representation for zero and NaN
+	bits := math.Float64bits(val)
+	if val == 0 {
+		bits = 0
+	} else if math.IsNaN(val) {
+		bits = canonicalNaN
+	}
+	ret := make([]byte, 9)
+	ret[0] = typeFloat
+	binary.LittleEndian.PutUint64(ret[1:], bits)
+	return ret
+}
+
+// ToBadgerType convert the specified scalar into something stored in a Badger KV store.  The encoding is canonical:
+// equal documents always produce identical bytes, regardless of map ordering or the Go types used to hold numbers
 func ToBadgerType(val interface{}) ([]byte, error) {
 	switch v := val.(type) {
 	case bool:
@@ -239,15 +266,9 @@ func ToBadgerType(val interface{}) ([]byte, error) {
 		}
 		return ret, nil
 	case float32:
-		bits := make([]byte, 4)
-		binary.LittleEndian.PutUint32(bits, math.Float32bits(v))
-		ret := append([]byte{typeFloat}, bits...)
-		return ret, nil
+		return toBadgerTypeFloat(float64(v)), nil
 	case float64:
-		bits := make([]byte, 8)
-		binary.LittleEndian.PutUint64(bits, math.Float64bits(v))
-		ret := append([]byte{typeFloat}, bits...)
-		return ret, nil
+		return toBadgerTypeFloat(v), nil
 	case uint8:
 		return toBadgerTypeUint(uint64(v)), nil
 	case uint16:
@@ -269,15 +290,12 @@ func ToBadgerType(val interface{}) ([]byte, error) {
 	case uint:
 		return toBadgerTypeUint(uint64(v)), nil
 	case json.Number:
-		if strings.Contains(string(v), ".") {
+		if strings.ContainsAny(string(v), ".eE") {
 			num, err := strconv.ParseFloat(string(v), 64)
 			if err != nil {
 				return nil, err
 			}
-			bits := make([]byte, 8)
-			binary.LittleEndian.PutUint64(bits, math.Float64bits(num))
-			ret := append([]byte{typeFloat}, bits...)
-			return ret, nil
+			return toBadgerTypeFloat(num), nil
 		}
 		num, err := strconv.ParseInt(string(v), 10, 64)
 		if err == nil {
@@ -319,8 +337,15 @@ func ToBadgerType(val interface{}) ([]byte, error) {
 		}
 		return result, nil
 	case map[string]interface{}:
+		// keys are written in sorted order so a document always has the same encoding
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
 		result := []byte{typeMap}
-		for key, value := range v {
+		for _, key := range keys {
+			value := v[key]
 			entry, err := ToBadgerType(value)
 			if err != nil {
 				return nil, err
@@ -336,6 +361,24 @@ func ToBadgerType(val interface{}) ([]byte, error) {
 	}
 }
 
+// checkCanonical verifies that an encoded value is exactly what ToBadgerType would produce for it.  Values written
+// before the encoding was made canonical (unsorted maps, padded integers, single-precision floats) remain readable
+// through fromBadgerType but will fail this check
+func checkCanonical(val []byte) error {
+	decoded, err := fromBadgerType(val)
+	if err != nil {
+		return err
+	}
+	encoded, err := ToBadgerType(decoded)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(val, encoded) {
+		return errors.New("value is not in canonical form")
+	}
+	return nil
+}
+
 func readVarint(src []byte) (uint64, uint) {
 	c := src[0]
 	if c < 0x80 {
@@ -413,25 +456,19 @@ func writeVarint(val uint64) []byte {
 	return result
 }
 
-// GetBadgerVal retrieve the specified key as a scalar from a Badger KV store
-func GetBadgerVal(txn *badger.Txn, key string) (interface{}, error) {
-	item, err := txn.Get([]byte(key))
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return nil, nil
-		}
+// GetBadgerVal retrieve the specified key as a scalar from the KV store
+func GetBadgerVal(txn KVTxn, key string) (interface{}, error) {
+	// we take a copy here as decoded []byte values would otherwise reference memory only valid within the transaction
+	val, err := getBadgerRaw(txn, key)
+	if err != nil || val == nil {
 		return nil, err
 	}
-	var result interface{}
-	err = item.Value(func(val []byte) error {
-		iVal, err := fromBadgerType(val)
-		if err != nil {
-			return err
-		}
-		result = iVal
-		return nil
-	})
-	return result, err
+	return fromBadgerType(val)
+}
+
+// getBadgerRaw retrieve the specified key from the KV store without decoding it
+func getBadgerRaw(txn KVTxn, key string) ([]byte, error) {
+	return txn.Get([]byte(key))
 }
 
 func storeDenseKey(store map[string]interface{}, key string, val interface{}) {
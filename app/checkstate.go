@@ -0,0 +1,29 @@
+package app
+
+// Holds the state that CheckTx validates transactions against: a view of the last committed block that is never
+// committed itself, carrying the writes of every transaction accepted into the mempool since.  A transaction may
+// therefore depend on one still waiting in the mempool (such as a new user's first write following its creation).
+// The view is discarded at each Commit, after which Tendermint rechecks whatever remains in the mempool against it
+
+import (
+	"errors"
+	"sync"
+)
+
+var errNoCheckState = errors.New("Chain has not been initialized")
+
+type checkStateData struct {
+	mtx     sync.Mutex  // held by CheckTx and by anything replacing the view
+	txn     KVTxn       // view of the last committed block, with the writes of checked transactions (never committed)
+	undoLog []undoEntry // changes made to txn by the transaction being checked
+}
+
+// resetCheckState discards the writes of any transactions checked since the last block, starting again from its
+// state (the caller must hold app.checkState.mtx)
+func (app *AthenaStoreApplication) resetCheckState() {
+	if app.checkState.txn != nil {
+		app.checkState.txn.Discard()
+	}
+	app.checkState.txn = app.db.NewTransactionAt(heightVersion(app.treeState.lastBlockHeight), true)
+	app.checkState.undoLog = nil
+}
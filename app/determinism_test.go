@@ -0,0 +1,134 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmlog "github.com/tendermint/tendermint/libs/log"
+)
+
+const testChainID = "athenamesh-test"
+
+func testKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+func newTestApp(t *testing.T, rootKey ed25519.PrivateKey) *AthenaStoreApplication {
+	app := NewAthenaStoreApplication(NewMemoryStore(), AppConfig{}, tmlog.NewNopLogger())
+
+	appState, err := json.Marshal(GenesisState{
+		RootPubKey: base64.RawURLEncoding.EncodeToString(rootKey.Public().(ed25519.PublicKey)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.InitChain(abcitypes.RequestInitChain{ChainId: testChainID, AppStateBytes: appState})
+	return app
+}
+
+func signTestTx(key ed25519.PrivateKey, nonce int64, body []byte) []byte {
+	nonceAndBody := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(nonceAndBody, uint64(nonce))
+	nonceAndBody = append(nonceAndBody, body...)
+	tx := append([]byte{}, key.Public().(ed25519.PublicKey)...)
+	tx = append(tx, ed25519.Sign(key, TxSignBytes(testChainID, nonceAndBody))...)
+	return append(tx, nonceAndBody...)
+}
+
+func runTestBlock(t *testing.T, app *AthenaStoreApplication, height int64, txs [][]byte) []byte {
+	app.BeginBlock(abcitypes.RequestBeginBlock{})
+	for idx, tx := range txs {
+		resp := app.DeliverTx(abcitypes.RequestDeliverTx{Tx: tx})
+		if resp.Code != 0 {
+			t.Fatalf("transaction %d failed with code %d: %s", idx, resp.Code, resp.Info)
+		}
+	}
+	app.EndBlock(abcitypes.RequestEndBlock{Height: height})
+	return app.Commit().Data
+}
+
+func dumpTestStore(t *testing.T, app *AthenaStoreApplication) map[string][]byte {
+	result := make(map[string][]byte)
+	txn := app.db.NewTransactionAt(math.MaxUint64, false)
+	defer txn.Discard()
+	iter := txn.NewIterator(KVIteratorOptions{})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[string(iter.Key())] = val
+	}
+	return result
+}
+
+// TestMapTxDeterminism runs the same map-form transactions through two instances, written with their keys in
+// different orders, and expects them to arrive at the same app hash and identical stores
+func TestMapTxDeterminism(t *testing.T) {
+	rootKey := testKey(1)
+	carolKey := testKey(2)
+	carolPubKey := base64.RawURLEncoding.EncodeToString(carolKey.Public().(ed25519.PublicKey))
+
+	bodies := []struct {
+		key   ed25519.PrivateKey
+		nonce int64
+		bodyA string
+		bodyB string
+	}{
+		{carolKey, 0,
+			`{"user/carol/auth":{"pubKey":"` + carolPubKey + `","bio":"hi"}}`,
+			`{"user/carol/auth":{"bio":"hi","pubKey":"` + carolPubKey + `"}}`},
+		{carolKey, 1,
+			`{"user/carol/store/b":true,"user/carol/privStore/x":1.5,` +
+				`"user/carol/store/profile":{"tags":["a","b"],"name":"Carol","age":30},` +
+				`"user/carol/auth":{"pubKey":"` + carolPubKey + `","bio":"hello"}}`,
+			`{"user/carol/auth":{"bio":"hello","pubKey":"` + carolPubKey + `"},` +
+				`"user/carol/store/profile":{"age":30,"name":"Carol","tags":["a","b"]},` +
+				`"user/carol/privStore/x":1.5,"user/carol/store/b":true}`},
+		{rootKey, 0,
+			`{"world/c":[1,2,3],"user/dave/store/b":false,"user/dave/store/a":"a","user/carol/email":{"hash":"carolhash"}}`,
+			`{"user/carol/email":{"hash":"carolhash"},"user/dave/store/a":"a","user/dave/store/b":false,"world/c":[1,2,3]}`},
+	}
+	txsA := make([][]byte, 0, len(bodies))
+	txsB := make([][]byte, 0, len(bodies))
+	for _, body := range bodies {
+		txsA = append(txsA, signTestTx(body.key, body.nonce, []byte(body.bodyA)))
+		txsB = append(txsB, signTestTx(body.key, body.nonce, []byte(body.bodyB)))
+	}
+
+	appA := newTestApp(t, rootKey)
+	appB := newTestApp(t, rootKey)
+
+	hashA := runTestBlock(t, appA, 1, txsA)
+	hashB := runTestBlock(t, appB, 1, txsB)
+	if !bytes.Equal(hashA, hashB) {
+		t.Fatalf("commit hashes differ: %x != %x", hashA, hashB)
+	}
+
+	storeA := dumpTestStore(t, appA)
+	storeB := dumpTestStore(t, appB)
+	if len(storeA) != len(storeB) {
+		t.Errorf("stores hold %d and %d keys", len(storeA), len(storeB))
+	}
+	for key, valA := range storeA {
+		valB, ok := storeB[key]
+		if !ok {
+			t.Errorf("key %s is missing from the second store", key)
+		} else if !bytes.Equal(valA, valB) {
+			t.Errorf("key %s differs: %x != %x", key, valA, valB)
+		}
+	}
+	if _, ok := storeA["users/email/carolhash"]; !ok {
+		t.Error("expected the email symlink to have been created")
+	}
+	if _, ok := storeA["keyMap/"+carolPubKey]; !ok {
+		t.Error("expected the user to have been created")
+	}
+}
@@ -0,0 +1,87 @@
+package app
+
+// Describes the events we attach to each transaction, so that clients can find transactions with tx_search or
+// subscribe to changes over /websocket (such as tm.event='Tx' AND athenaWrite.key='user/bob/domain/home/loc')
+//
+// athenaTx (one per transaction):
+//   signer      - path of the account that signed the transaction (absent if a new user is creating itself)
+//   signerKey   - public key (base64url) that signed the transaction (repeated for each key of a multi-signature one)
+// athenaWrite (one per key written):
+//   key         - the key written, after symlinks are resolved
+//   account     - path of the account that the key lives under (absent if it is not under any account)
+//   accountType - type of that account (root, user, login, group, domain)
+//   created     - "true" if the key did not previously exist
+//   deleted     - "true" if the key was deleted
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/libs/kv"
+)
+
+const (
+	// EventTypeTx is emitted once for every successful transaction
+	EventTypeTx = "athenaTx"
+	// EventTypeWrite is emitted for every key written by a successful transaction
+	EventTypeWrite = "athenaWrite"
+)
+
+// IndexedEventKeys are the event attributes the Tendermint indexer should index (tx_index.index_keys) for
+// clients to be able to search by signer, key, or account
+var IndexedEventKeys = []string{
+	EventTypeTx + ".signer",
+	EventTypeWrite + ".key",
+	EventTypeWrite + ".account",
+}
+
+// accountOfKey returns the innermost account that the specified key lives under
+func accountOfKey(key string) (*loginEntry, string) {
+	segments := strings.Split(key, "/")
+	for idx := len(segments) - 1; idx > 0; idx-- {
+		acctPath := strings.Join(segments[:idx], "/")
+		if login, _ := domainUserTypes.MatchFromPath(acctPath); login != nil {
+			return login, acctPath
+		}
+	}
+	return nil, ""
+}
+
+func txEvent(login *loginEntry, tx *athenaTx) abcitypes.Event {
+	attrs := []kv.Pair{}
+	if login != nil {
+		attrs = append(attrs, kv.Pair{Key: []byte("signer"), Value: []byte(login.path())})
+	}
+	signerKeys := []ed25519.PublicKey{tx.Pkey}
+	if tx.MultiSig != nil {
+		signerKeys = tx.MultiSig.signers
+	}
+	for _, pubKey := range signerKeys {
+		attrs = append(attrs, kv.Pair{Key: []byte("signerKey"), Value: []byte(base64.RawURLEncoding.EncodeToString(pubKey))})
+	}
+	return abcitypes.Event{Type: EventTypeTx, Attributes: attrs}
+}
+
+// writeEvent describes a write to the specified key, which must be called before the write takes place
+func writeEvent(txn KVTxn, key string, value interface{}) (abcitypes.Event, error) {
+	attrs := []kv.Pair{{Key: []byte("key"), Value: []byte(key)}}
+	if acct, acctPath := accountOfKey(key); acct != nil {
+		attrs = append(attrs,
+			kv.Pair{Key: []byte("account"), Value: []byte(acctPath)},
+			kv.Pair{Key: []byte("accountType"), Value: []byte(acct.Type.TypeName)})
+	}
+
+	oldValue, err := getBadgerRaw(txn, key)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	if oldValue == nil && value != nil {
+		attrs = append(attrs, kv.Pair{Key: []byte("created"), Value: []byte("true")})
+	}
+	if value == nil {
+		attrs = append(attrs, kv.Pair{Key: []byte("deleted"), Value: []byte("true")})
+	}
+	return abcitypes.Event{Type: EventTypeWrite, Attributes: attrs}, nil
+}
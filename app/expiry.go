@@ -0,0 +1,160 @@
+package app
+
+// Tracks accounts that carry an "expires" attribute so that they can be swept from the store once they lapse.
+// The index lives under mesh/ (outside the merkle tree) as it can always be rebuilt from the /auth entries themselves.
+// The sweep is limited in how much it deletes per block, but a lapsed account can no longer sign even before it is swept
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const expiryIndexPrefix = "mesh/expiry/"
+
+// expiryKeysPerBlock is the number of keys the expiry sweep deletes at the end of each block
+const expiryKeysPerBlock = 1000
+
+var errAccountExpired = errors.New("Account has expired")
+
+// expiryIndexKey sorts the index by expiry height (fixed-width hex) so we can stop scanning at the first live entry
+func expiryIndexKey(expires int64, authPath string) string {
+	return fmt.Sprintf("%s%016x/%s", expiryIndexPrefix, uint64(expires), authPath)
+}
+
+func accountExpires(value interface{}) int64 {
+	if acctData, ok := value.(map[string]interface{}); ok {
+		if expires, ok := NumberToInt64(acctData["expires"]); ok {
+			return expires
+		}
+	}
+	return 0
+}
+
+func (app *AthenaStoreApplication) handleExpiryChange(txn KVTxn, authPath string, value interface{}) error {
+	var oldExpires int64
+	gOldAcctData, err := GetBadgerVal(txn, authPath)
+	if err == nil && gOldAcctData != nil {
+		oldExpires = accountExpires(gOldAcctData)
+	}
+	var newExpires int64
+	if value != nil {
+		newExpires = accountExpires(value)
+	}
+
+	if oldExpires == newExpires {
+		return nil
+	}
+	if oldExpires > 0 {
+		err = app.storeRaw(txn, expiryIndexKey(oldExpires, authPath), nil)
+		if err != nil {
+			return err
+		}
+	}
+	if newExpires > 0 {
+		encPath, err := ToBadgerType(authPath)
+		if err != nil {
+			return err
+		}
+		return app.storeRaw(txn, expiryIndexKey(newExpires, authPath), encPath)
+	}
+	return nil
+}
+
+// canChangeExpiry checks that login may change the expiry of acct from oldExpires.  Anyone able to write an account
+// may bring its expiry forward, but only root or the account's parent (an admin, for a group) may extend or remove it
+func (app *AthenaStoreApplication) canChangeExpiry(txn KVTxn, login *loginEntry, acct *loginEntry, oldExpires int64) (bool, error) {
+	newExpires := acct.Expires
+	if oldExpires == 0 || newExpires == oldExpires || (newExpires > 0 && newExpires < oldExpires) {
+		return true, nil
+	}
+	if login.Type == rootUserTypeConfig {
+		return true, nil
+	}
+	if acct.Parent == nil {
+		return false, nil
+	}
+	parentPath := acct.Parent.path()
+	if login.path() == parentPath {
+		return true, nil
+	}
+	if acct.Parent.Type == groupUserTypeConfig {
+		return app.hasGroupRole(txn, login, parentPath, groupRoleAdmin)
+	}
+	return false, nil
+}
+
+// nextExpiredAccount returns the first entry of the expiry index for an account that may not be used after the
+// specified block height, along with the account record it points at (empty strings if there is none)
+func nextExpiredAccount(txn KVTxn, height int64) (string, string, error) {
+	lastKey := expiryIndexKey(height, "\xff")
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(expiryIndexPrefix)})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		indexKey := string(iter.Key())
+		if indexKey > lastKey {
+			break
+		}
+		val, err := iter.Value()
+		if err != nil {
+			return "", "", err
+		}
+		authPath, err := fromBadgerType(val)
+		if err != nil {
+			return "", "", err
+		}
+		strAuthPath, _ := authPath.(string)
+		return indexKey, strAuthPath, nil
+	}
+	return "", "", nil
+}
+
+// expireAccounts deletes the accounts that may not be used after the specified block height, just as if they had
+// been deleted by a transaction.  No more than expiryKeysPerBlock keys are deleted in one block; the expiry index
+// serves as the cursor, as an account is taken apart with its record going last and only then leaves the index
+func (app *AthenaStoreApplication) expireAccounts(txn KVTxn, height int64) error {
+	budget := expiryKeysPerBlock
+	for budget > 0 {
+		indexKey, authPath, err := nextExpiredAccount(txn, height)
+		if err != nil || indexKey == "" {
+			return err
+		}
+		if authPath == "" {
+			// not something we could have written, drop it
+			if err = app.storeRaw(txn, indexKey, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		acctPath := strings.TrimSuffix(authPath, "/auth")
+
+		var keys []string
+		iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(acctPath + "/"), KeysOnly: true})
+		for iter.Rewind(); iter.Valid() && len(keys) < budget; iter.Next() {
+			if key := string(iter.Key()); key != authPath {
+				keys = append(keys, key)
+			}
+		}
+		iter.Close()
+		for _, key := range keys {
+			if err = app.setKey(txn, key, nil); err != nil {
+				return err
+			}
+		}
+		budget -= len(keys)
+		if budget == 0 {
+			return nil // the rest of this account will have to wait for the next block
+		}
+
+		app.logger.Info("expiring account " + authPath)
+		if _, err = app.deleteAccount(txn, acctPath); err != nil {
+			return err
+		}
+		// the index entry should have gone with the account record, make sure of it so the sweep cannot get stuck
+		if err = app.storeRaw(txn, indexKey, nil); err != nil {
+			return err
+		}
+		budget--
+	}
+	return nil
+}
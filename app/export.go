@@ -0,0 +1,427 @@
+package app
+
+// Writes the state of the chain out as a JSON document, and builds a genesis app_state or a fresh store from one.
+// A dump is a single object:
+//   chainId - chain the state was taken from
+//   height  - block height the state is as of
+//   appHash - application hash reported for that block (hex)
+//   keys    - every key in the store -> its decoded value, in byte order
+// The merkle tree nodes and the block state are left out, as both are rebuilt from the rest, as is the schema version
+// of the store (see migrate.go).  Values whose type JSON cannot carry on its own are tagged as a single-entry map:
+//   $bytes - a byte string (base64url)
+//   $float - a float that is not finite ("NaN", "+Inf" or "-Inf"); finite floats always carry a decimal point
+//   $map   - a map that would otherwise be mistaken for one of these tags
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	cfg "github.com/tendermint/tendermint/config"
+	tmlog "github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+// ExportOptions controls what DoExport writes
+type ExportOptions struct {
+	Height  int64  // block height to export the state as of (0 = the last committed block)
+	OutFile string // file to write the dump to (stdout if empty)
+}
+
+// ImportOptions controls what DoImport builds from a dump
+type ImportOptions struct {
+	DumpFile string // file holding a dump written by DoExport
+	ToStore  bool   // load the dump into an empty store.db, rather than the app_state of the genesis file
+}
+
+type stateDump struct {
+	ChainID string                 `json:"chainId"`
+	Height  int64                  `json:"height"`
+	AppHash string                 `json:"appHash"`
+	Keys    map[string]interface{} `json:"keys"`
+}
+
+// isDumpedKey returns whether a key in the store belongs in a dump
+func isDumpedKey(key string) bool {
+	return !strings.HasPrefix(key, merkleNodePrefix) && key != "mesh/blockState" && key != schemaVersionKey
+}
+
+// exportValue converts a decoded value into something that can be written as JSON without losing its type
+func exportValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return map[string]interface{}{"$bytes": base64.RawURLEncoding.EncodeToString(v)}
+	case float32:
+		return exportValue(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return map[string]interface{}{"$float": strconv.FormatFloat(v, 'g', -1, 64)}
+		}
+		num := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(num, ".eE") {
+			num += ".0"
+		}
+		return json.Number(num)
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, entry := range v {
+			result = append(result, exportValue(entry))
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			result[key] = exportValue(entry)
+		}
+		if len(v) == 1 {
+			for key := range v {
+				if strings.HasPrefix(key, "$") {
+					return map[string]interface{}{"$map": result}
+				}
+			}
+		}
+		return result
+	}
+	return val
+}
+
+// importValue reverses exportValue, returning a value that ToBadgerType encodes exactly as it was stored
+func importValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, entry := range v {
+			decoded, err := importValue(entry)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, decoded)
+		}
+		return result, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if tagged, ok := v["$bytes"]; ok {
+				strBytes, ok := tagged.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected $bytes value %v", tagged)
+				}
+				return base64.RawURLEncoding.DecodeString(strBytes)
+			}
+			if tagged, ok := v["$float"]; ok {
+				strFloat, ok := tagged.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected $float value %v", tagged)
+				}
+				return strconv.ParseFloat(strFloat, 64)
+			}
+			if tagged, ok := v["$map"]; ok {
+				inner, ok := tagged.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("unexpected $map value %v", tagged)
+				}
+				v = inner
+			}
+		}
+		result := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			decoded, err := importValue(entry)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = decoded
+		}
+		return result, nil
+	}
+	return val, nil
+}
+
+// genesisValue converts an imported value into the form accepted by the genesis file, where byte strings
+// (such as the keys of an account) are given as base64url
+func genesisValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return base64.RawURLEncoding.EncodeToString(v)
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, entry := range v {
+			result = append(result, genesisValue(entry))
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			result[key] = genesisValue(entry)
+		}
+		return result
+	}
+	return val
+}
+
+// exportState streams the state of the store as of the specified height (0 = the last committed block)
+func exportState(store KVStore, height int64, out io.Writer) error {
+	version := uint64(math.MaxUint64)
+	if height > 0 {
+		version = heightVersion(height)
+	}
+	txn := store.NewTransactionAt(version, false)
+	defer txn.Discard()
+	state, err := readBlockState(txn)
+	if err != nil {
+		return err
+	}
+	if len(state.lastBlockHash) == 0 {
+		return errors.New("store does not hold any chain state")
+	}
+	if height > 0 && state.lastBlockHeight != height {
+		return fmt.Errorf("block %d is not retained in the store", height)
+	}
+
+	header, err := json.Marshal(map[string]interface{}{
+		"chainId": state.chainID,
+		"height":  state.lastBlockHeight,
+		"appHash": fmt.Sprintf("%X", state.lastBlockHash),
+	})
+	if err != nil {
+		return err
+	}
+	// leave the header object open so the keys can follow it one at a time
+	if _, err = fmt.Fprintf(out, "%s,\"keys\":{", header[:len(header)-1]); err != nil {
+		return err
+	}
+
+	iter := txn.NewIterator(KVIteratorOptions{})
+	defer iter.Close()
+	separator := "\n"
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if !isDumpedKey(key) {
+			continue
+		}
+		rawValue, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		value, err := fromBadgerType(rawValue)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode %s", key)
+		}
+		jsonKey, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		jsonValue, err := json.Marshal(exportValue(value))
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode %s", key)
+		}
+		if _, err = fmt.Fprintf(out, "%s%s:%s", separator, jsonKey, jsonValue); err != nil {
+			return err
+		}
+		separator = ",\n"
+	}
+	_, err = io.WriteString(out, "\n}}\n")
+	return err
+}
+
+func readStateDump(dumpFile string) (*stateDump, error) {
+	jsonBytes, err := ioutil.ReadFile(dumpFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read dump file")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	dump := &stateDump{}
+	if err := decoder.Decode(dump); err != nil {
+		return nil, errors.Wrap(err, "failed to parse dump file")
+	}
+	for key, value := range dump.Keys {
+		decoded, err := importValue(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", key)
+		}
+		dump.Keys[key] = decoded
+	}
+	return dump, nil
+}
+
+// genesisState builds a genesis app_state holding the accounts and data of the dump.  Anything the chain derives
+// for itself (symlinks, the indexes under mesh/ and nonce tombstones) is left out, as are nonces and creation
+// heights; the root user keeps only its keys
+func (dump *stateDump) genesisState() (*GenesisState, error) {
+	symlinks := defaultSymLinkPaths
+	if gSymlinks, ok := dump.Keys[symlinksKey]; ok {
+		var err error
+		if symlinks, err = parseSymlinkEntries(gSymlinks); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &GenesisState{
+		Accounts: make(map[string]map[string]interface{}),
+		Data:     make(map[string]interface{}),
+	}
+	for key, value := range dump.Keys {
+		if !isMerkleKey(key) || strings.HasPrefix(key, "keyMap/") {
+			continue
+		}
+		isSymlink := false
+		for _, typ := range symlinks {
+			isSymlink = isSymlink || strings.HasPrefix(key, typ.DestPrefix)
+		}
+		if isSymlink {
+			continue
+		}
+		if !strings.HasSuffix(key, "/auth") {
+			state.Data[key] = genesisValue(value)
+			continue
+		}
+
+		acctData, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("account %s is not a map", key)
+		}
+		acctPath := strings.TrimSuffix(key, "/auth")
+		if acctPath != "config/rootUser" {
+			state.Accounts[acctPath] = genesisValue(acctData).(map[string]interface{})
+			continue
+		}
+		root := &loginEntry{Type: rootUserTypeConfig}
+		if err := root.decodeAccountData(acctData, acctPath, false); err != nil {
+			return nil, err
+		}
+		if root.isMultiSig() {
+			for _, pubKey := range root.PubKeys {
+				state.RootPubKeys = append(state.RootPubKeys, base64.RawURLEncoding.EncodeToString(pubKey))
+			}
+			state.RootThreshold = root.Threshold
+		} else {
+			state.RootPubKey = base64.RawURLEncoding.EncodeToString(root.Pubkey)
+		}
+	}
+	if state.RootPubKey == "" && len(state.RootPubKeys) == 0 {
+		return nil, errors.New("dump does not hold a root user")
+	}
+	return state, nil
+}
+
+// importStore loads the dump into an empty store, as of the height it was taken at
+func (app *AthenaStoreApplication) importStore(dump *stateDump) error {
+	if len(app.treeState.lastBlockHash) != 0 {
+		return errors.New("store already holds chain state, an import needs an empty store")
+	}
+	keys := make([]string, 0, len(dump.Keys))
+	for key := range dump.Keys {
+		if !isDumpedKey(key) {
+			return fmt.Errorf("dump cannot declare %s", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	appHash, err := hex.DecodeString(dump.AppHash)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the app hash of the dump")
+	}
+	for start := 0; start < len(keys); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values := make([][]byte, 0, end-start)
+		for _, key := range keys[start:end] {
+			encData, err := ToBadgerType(dump.Keys[key])
+			if err != nil {
+				return errors.Wrapf(err, "failed to encode %s", key)
+			}
+			values = append(values, encData)
+		}
+		if err = app.restoreBatch(dump.Height, keys[start:end], values); err != nil {
+			return err
+		}
+	}
+	return app.finishRestore(dump.ChainID, dump.Height, appHash)
+}
+
+// DoExport writes the state held in store.db out as a dump
+func DoExport(config *cfg.Config, opts ExportOptions, logger tmlog.Logger) error {
+	// the dump may be going to stdout along with our log, keep badger quiet
+	db, err := openToolStore(config, tmlog.NewFilter(logger, tmlog.AllowError()))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if opts.OutFile != "" {
+		out, err = os.Create(opts.OutFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to create dump file")
+		}
+		defer out.Close()
+	}
+	writer := bufio.NewWriter(out)
+	err = exportState(NewBadgerStore(db), opts.Height, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to export state")
+	}
+	return nil
+}
+
+// DoImport builds the app_state of the genesis file, or an empty store.db, from a dump
+func DoImport(config *cfg.Config, opts ImportOptions, logger tmlog.Logger) error {
+	dump, err := readStateDump(opts.DumpFile)
+	if err != nil {
+		return err
+	}
+
+	if !opts.ToStore {
+		state, err := dump.genesisState()
+		if err != nil {
+			return errors.Wrap(err, "failed to construct genesis app_state")
+		}
+		appState, err := json.Marshal(state)
+		if err != nil {
+			return errors.Wrap(err, "failed to construct genesis app_state")
+		}
+		genFile := config.GenesisFile()
+		genDoc, err := types.GenesisDocFromFile(genFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read genesis file (run init first)")
+		}
+		genDoc.AppState = appState
+		if err := genDoc.SaveAs(genFile); err != nil {
+			return errors.Wrap(err, "failed to write genesis file")
+		}
+		logger.Info("Imported state into genesis file", "path", genFile, "chain", genDoc.ChainID,
+			"accounts", len(state.Accounts), "keys", len(state.Data))
+		return nil
+	}
+
+	db, err := openToolStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	app := NewAthenaStoreApplication(NewBadgerStore(db), AppConfig{}, logger)
+	defer func() {
+		app.checkState.txn.Discard()
+	}()
+	if err := app.importStore(dump); err != nil {
+		return errors.Wrap(err, "failed to import state")
+	}
+	logger.Info("Imported state into store", "chain", dump.ChainID, "height", dump.Height, "appHash", dump.AppHash)
+	return nil
+}
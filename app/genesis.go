@@ -0,0 +1,247 @@
+package app
+
+// Describes the initial state of the chain as carried in the app_state of the genesis file, and manages the key
+// file holding the private key of the root user
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	tmos "github.com/tendermint/tendermint/libs/os"
+)
+
+// GenesisState is the app_state of our genesis file
+type GenesisState struct {
+	RootPubKey    string                            `json:"rootPubKey,omitempty"`    // public key of config/rootUser (base64url)
+	RootPubKeys   []string                          `json:"rootPubKeys,omitempty"`   // public keys of a multi-signature config/rootUser, instead of rootPubKey
+	RootThreshold int64                             `json:"rootThreshold,omitempty"` // number of rootPubKeys that must sign for config/rootUser
+	Accounts      map[string]map[string]interface{} `json:"accounts,omitempty"`      // account path (such as user/bob) -> its /auth attributes
+	Data          map[string]interface{}            `json:"data,omitempty"`          // any other keys to populate (such as config/permissions or config/symlinks)
+}
+
+type rootKeyFile struct {
+	PubKey  string `json:"pubKey"`
+	PrivKey string `json:"privKey"`
+}
+
+func decodeGenesisState(appState []byte) (*GenesisState, error) {
+	if len(bytes.TrimSpace(appState)) == 0 {
+		return nil, errors.New("genesis file has no app_state")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(appState))
+	decoder.UseNumber()
+	state := &GenesisState{}
+	if err := decoder.Decode(state); err != nil {
+		return nil, errors.Wrap(err, "failed to parse genesis app_state")
+	}
+	if (state.RootPubKey == "") == (len(state.RootPubKeys) == 0) {
+		return nil, errors.New("genesis app_state must declare either a rootPubKey or rootPubKeys")
+	}
+	return state, nil
+}
+
+// rootAccount returns the root user declared by the genesis state
+func (state *GenesisState) rootAccount() (*loginEntry, error) {
+	root := &loginEntry{Type: rootUserTypeConfig}
+	if state.RootPubKey != "" {
+		rootPubKey, err := base64.RawURLEncoding.DecodeString(state.RootPubKey)
+		if err != nil || len(rootPubKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("genesis rootPubKey %s is not a valid public key", state.RootPubKey)
+		}
+		root.Pubkey = rootPubKey
+		return root, nil
+	}
+	for _, encPubKey := range state.RootPubKeys {
+		rootPubKey, err := base64.RawURLEncoding.DecodeString(encPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("genesis rootPubKeys entry %s is not a valid public key", encPubKey)
+		}
+		root.PubKeys = append(root.PubKeys, rootPubKey)
+	}
+	root.Threshold = state.RootThreshold
+	if err := root.checkKeys(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// describeRoot summarizes the keys of the root user declared by the genesis state, for the log
+func (state *GenesisState) describeRoot() string {
+	if state.RootPubKey != "" {
+		return "public key " + state.RootPubKey
+	}
+	return fmt.Sprintf("%d of the public keys %s", state.RootThreshold, strings.Join(state.RootPubKeys, ", "))
+}
+
+// applyGenesisState writes the root user, accounts, and other keys declared in the genesis file
+func (app *AthenaStoreApplication) applyGenesisState(txn KVTxn, state *GenesisState) error {
+	root, err := state.rootAccount()
+	if err != nil {
+		return err
+	}
+	err = app.createRootUser(txn, root)
+	if err != nil {
+		return err
+	}
+
+	// any symlinks declared here apply to the genesis data itself, there is nothing to backfill
+	if gSymlinks, ok := state.Data[symlinksKey]; ok {
+		if app.symlinks, err = parseSymlinkEntries(gSymlinks); err != nil {
+			return err
+		}
+	}
+
+	// parents must be written before their children, every node must apply these identically
+	acctPaths := make([]string, 0, len(state.Accounts))
+	for path := range state.Accounts {
+		acctPaths = append(acctPaths, path)
+	}
+	sort.Slice(acctPaths, func(i, j int) bool { return canonicalKeyLess(acctPaths[i], acctPaths[j]) })
+	for _, path := range acctPaths {
+		login, _ := domainUserTypes.MatchFromPath(path)
+		if login == nil || login.Type == rootUserTypeConfig {
+			return fmt.Errorf("genesis account %s is not a recognized account path", path)
+		}
+		err = login.decodeAccountData(state.Accounts[path], path, true)
+		if err != nil {
+			return err
+		}
+		if err = login.checkKeys(); err != nil {
+			return errors.Wrapf(err, "genesis account %s", path)
+		}
+		if !login.isMultiSig() && len(login.Pubkey) != ed25519.PublicKeySize {
+			return fmt.Errorf("genesis account %s does not have a valid pubKey", path)
+		}
+		err = app.setKey(txn, path+"/auth", login.assembleAccountData())
+		if err != nil {
+			return err
+		}
+	}
+
+	dataKeys := make([]string, 0, len(state.Data))
+	for key := range state.Data {
+		dataKeys = append(dataKeys, key)
+	}
+	sort.Slice(dataKeys, func(i, j int) bool { return canonicalKeyLess(dataKeys[i], dataKeys[j]) })
+	for _, key := range dataKeys {
+		if !isMerkleKey(key) || strings.HasPrefix(key, "keyMap/") || strings.HasSuffix(key, "/auth") {
+			return fmt.Errorf("genesis data cannot declare %s (accounts belong under \"accounts\")", key)
+		}
+		if key == permissionsKey {
+			if _, err := parsePermissionRules(state.Data[key]); err != nil {
+				return err
+			}
+		}
+		err = app.setKey(txn, key, state.Data[key])
+		if err != nil {
+			return err
+		}
+	}
+
+	// record the permission table and symlinks on the chain so that they can be seen and changed by root
+	if _, ok := state.Data[permissionsKey]; !ok {
+		err = app.setKey(txn, permissionsKey, encodePermissionRules(defaultPermissionRules()))
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := state.Data[symlinksKey]; !ok {
+		err = app.setKey(txn, symlinksKey, encodeSymlinkEntries(defaultSymLinkPaths))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// genesisApplied checks whether the store already holds the genesis state of the specified chain, failing if it
+// holds the state of some other chain
+func genesisApplied(txn KVTxn, chainID string, state *GenesisState) (bool, error) {
+	blockState, err := GetBadgerVal(txn, "mesh/blockState")
+	if err != nil || blockState == nil {
+		return false, err
+	}
+	treeState, err := readBlockState(txn)
+	if err != nil {
+		return false, err
+	}
+	if treeState.chainID != chainID {
+		return false, fmt.Errorf("store already holds chain %s", treeState.chainID)
+	}
+	want, err := state.rootAccount()
+	if err != nil {
+		return false, err
+	}
+	root := &loginEntry{Type: rootUserTypeConfig}
+	err = root.queryAccountData(txn, root.path(), "genesis")
+	if err != nil {
+		return false, err
+	}
+	if !root.sameKeys(want) {
+		return false, fmt.Errorf("store already holds chain %s with a different root user", chainID)
+	}
+	return true, nil
+}
+
+// loadRootPrivKey reads the root user's private key from the specified key file
+func loadRootPrivKey(keyFile string) (ed25519.PrivateKey, error) {
+	jsonBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read root key file")
+	}
+	key := rootKeyFile{}
+	if err := json.Unmarshal(jsonBytes, &key); err != nil {
+		return nil, errors.Wrap(err, "failed to parse root key file")
+	}
+	privKey, err := base64.RawURLEncoding.DecodeString(key.PrivKey)
+	if err != nil || len(privKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("root key file %s does not hold a valid private key", keyFile)
+	}
+	return privKey, nil
+}
+
+// LoadOrGenRootKey reads the root user's public key from the specified key file, creating the key if necessary
+func LoadOrGenRootKey(keyFile string) (ed25519.PublicKey, bool, error) {
+	if tmos.FileExists(keyFile) {
+		jsonBytes, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to read root key file")
+		}
+		key := rootKeyFile{}
+		if err := json.Unmarshal(jsonBytes, &key); err != nil {
+			return nil, false, errors.Wrap(err, "failed to parse root key file")
+		}
+		pubKey, err := base64.RawURLEncoding.DecodeString(key.PubKey)
+		if err != nil || len(pubKey) != ed25519.PublicKeySize {
+			return nil, false, fmt.Errorf("root key file %s does not hold a valid public key", keyFile)
+		}
+		return pubKey, false, nil
+	}
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to generate root key")
+	}
+	jsonBytes, err := json.MarshalIndent(rootKeyFile{
+		PubKey:  base64.RawURLEncoding.EncodeToString(pubKey),
+		PrivKey: base64.RawURLEncoding.EncodeToString(privKey),
+	}, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tmos.EnsureDir(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, false, errors.Wrap(err, "failed to create required folder")
+	}
+	if err := tmos.WriteFile(keyFile, jsonBytes, 0600); err != nil {
+		return nil, false, errors.Wrap(err, "failed to write root key file")
+	}
+	return pubKey, true, nil
+}
@@ -0,0 +1,157 @@
+package app
+
+// Manages the access grants that let an account share part of its tree with another account.  A grant is written by
+// the owning user at user/<name>/grant/<id> and is a map:
+//   grantee - path of the account being granted access (such as user/alice or user/alice/domain/home)
+//   path    - location within the owner's tree being shared (privStore, store, domain/<name>/privStore, ...)
+//   access  - "read" or "write" (which includes read)
+//   expires - last block height the grant may be used at (optional)
+// A grant to a user also applies to its logins and domains.  The owner revokes a grant by deleting it.  Grants are also
+// indexed by grantee under mesh/grantee/, so that they can be dropped when the grantee is deleted
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const granteeIndexPrefix = "mesh/grantee/"
+
+// grantPat identifies grant records, which may only be written by the user owning them (see "userGrant")
+var grantPat = regexp.MustCompile("^(user/[^/]+)/grant/[^/]+$")
+
+// grantTargetPat identifies the locations that can be shared by a grant, split into owner and path within the owner
+var grantTargetPat = regexp.MustCompile("^(user/[^/]+)/((domain/[^/]+/)?(privStore|store)(/.*)?)$")
+
+type accessGrant struct {
+	Grantee  string
+	Path     string
+	CanWrite bool
+	Expires  int64 // last block height this grant may be used at (zero if it does not expire)
+}
+
+func parseAccessGrant(value interface{}) (*accessGrant, error) {
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Grant must be a map")
+	}
+	grant := &accessGrant{}
+	for key, val := range entry {
+		var ok bool
+		switch key {
+		case "grantee":
+			grant.Grantee, ok = val.(string)
+		case "path":
+			grant.Path, ok = val.(string)
+		case "access":
+			var access string
+			if access, ok = val.(string); ok {
+				ok = access == "read" || access == "write"
+				grant.CanWrite = access == "write"
+			}
+		case "expires":
+			grant.Expires, ok = NumberToInt64(val)
+			ok = ok && grant.Expires > 0
+		default:
+			return nil, fmt.Errorf("Grant has unrecognized field %s", key)
+		}
+		if !ok {
+			return nil, fmt.Errorf("Grant has unexpected %s %v", key, val)
+		}
+	}
+	if grantee, _ := domainUserTypes.MatchFromPath(grant.Grantee); grantee == nil || grantee.Type == rootUserTypeConfig {
+		return nil, fmt.Errorf("Grant has unrecognized grantee %s", grant.Grantee)
+	}
+	if _, hasAccess := entry["access"]; !hasAccess {
+		return nil, errors.New("Grant is missing its access")
+	}
+	if matches := grantTargetPat.FindStringSubmatch("user/x/" + grant.Path); matches == nil {
+		return nil, fmt.Errorf("Grant cannot share %s", grant.Path)
+	}
+	return grant, nil
+}
+
+// granteeIndexKey is the index entry pointing at grantKey from its grantee.  The grantee path is closed off with a "/"
+// so that the grants naming an account and everything beneath it share a prefix
+func granteeIndexKey(grantee string, grantKey string) string {
+	return granteeIndexPrefix + grantee + "/=" + grantKey
+}
+
+// grantGrantee returns the account named by a grant record, if it has one
+func grantGrantee(value interface{}) string {
+	if entry, ok := value.(map[string]interface{}); ok {
+		if grantee, ok := entry["grantee"].(string); ok {
+			return grantee
+		}
+	}
+	return ""
+}
+
+func (app *AthenaStoreApplication) handleGrantChange(txn KVTxn, grantKey string, value interface{}) error {
+	var oldGrantee string
+	gOldGrant, err := GetBadgerVal(txn, grantKey)
+	if err == nil && gOldGrant != nil {
+		oldGrantee = grantGrantee(gOldGrant)
+	}
+	newGrantee := grantGrantee(value)
+
+	if oldGrantee == newGrantee {
+		return nil
+	}
+	if oldGrantee != "" {
+		err = app.storeRaw(txn, granteeIndexKey(oldGrantee, grantKey), nil)
+		if err != nil {
+			return err
+		}
+	}
+	if newGrantee != "" {
+		encKey, err := ToBadgerType(grantKey)
+		if err != nil {
+			return err
+		}
+		return app.storeRaw(txn, granteeIndexKey(newGrantee, grantKey), encKey)
+	}
+	return nil
+}
+
+// appliesTo checks whether this grant allows login to access relPath (a path within the owner's tree)
+func (grant *accessGrant) appliesTo(forWrite bool, login *loginEntry, relPath string, height int64) bool {
+	if (forWrite && !grant.CanWrite) || (grant.Expires > 0 && grant.Expires < height) {
+		return false
+	}
+	if relPath != grant.Path && !strings.HasPrefix(relPath, strings.TrimSuffix(grant.Path, "/")+"/") {
+		return false
+	}
+	return grant.Grantee == login.path() || (login.Parent != nil && grant.Grantee == login.Parent.path())
+}
+
+// hasGrant checks whether the owner of path has granted login access to it
+func (app *AthenaStoreApplication) hasGrant(txn KVTxn, forWrite bool, login *loginEntry, path string) (bool, error) {
+	matches := grantTargetPat.FindStringSubmatch(path)
+	if matches == nil {
+		return false, nil
+	}
+	height := app.currentHeight()
+
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(matches[1] + "/grant/")})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		if err != nil {
+			return false, err
+		}
+		gGrant, err := fromBadgerType(val)
+		if err != nil {
+			return false, err
+		}
+		grant, err := parseAccessGrant(gGrant)
+		if err != nil {
+			continue // not something we could have written, ignore it
+		}
+		if grant.appliesTo(forWrite, login, matches[2], height) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,201 @@
+package app
+
+// Manages group accounts, which let a team of users own domains and places together.  A group lives at group/<name>
+// and is founded by any user writing its account record (group/<name>/auth), who becomes its first owner.  The key in
+// that record is held by the owners and signs the group's domains, just as a user's key signs its own.  Membership is
+// recorded at group/<name>/member/<user name> as a map:
+//   role - "member" (may write the group's stores and places), "admin" (may also manage members and domains) or
+//          "owner" (may also change the group's account record and delete the group)
+// A member's logins act with the member's role.  Only an owner may add, remove, or change the role of an owner.
+// Memberships are also indexed by user name under mesh/memberOf/, so that they can be dropped when the user is deleted
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+const (
+	groupRoleNone = iota
+	groupRoleMember
+	groupRoleAdmin
+	groupRoleOwner
+)
+
+const memberIndexPrefix = "mesh/memberOf/"
+
+var groupRoleNames = map[int]string{
+	groupRoleMember: "member",
+	groupRoleAdmin:  "admin",
+	groupRoleOwner:  "owner",
+}
+
+var groupAuthPat = regexp.MustCompile("^(group/[^/]+)/auth$")
+
+var groupMemberPat = regexp.MustCompile("^(group/[^/]+)/member/([^/]+)$")
+
+// groupOfPathPat identifies the group (if any) that a path lives under
+var groupOfPathPat = regexp.MustCompile("^(group/[^/]+)(/|$)")
+
+func groupRoleByName(name string) int {
+	for role, roleName := range groupRoleNames {
+		if roleName == name {
+			return role
+		}
+	}
+	return groupRoleNone
+}
+
+func parseGroupMember(value interface{}) (int, error) {
+	entry, ok := value.(map[string]interface{})
+	if !ok {
+		return groupRoleNone, errors.New("Group member must be a map")
+	}
+	role := groupRoleNone
+	for key, val := range entry {
+		switch key {
+		case "role":
+			roleName, _ := val.(string)
+			if role = groupRoleByName(roleName); role == groupRoleNone {
+				return groupRoleNone, fmt.Errorf("Group member has unexpected role %v", val)
+			}
+		default:
+			return groupRoleNone, fmt.Errorf("Group member has unrecognized field %s", key)
+		}
+	}
+	if role == groupRoleNone {
+		return groupRoleNone, errors.New("Group member is missing its role")
+	}
+	return role, nil
+}
+
+// memberRole returns the role held by a user in a group (groupRoleNone if the user is not a member)
+func memberRole(txn KVTxn, groupPath string, userName string) (int, error) {
+	value, err := GetBadgerVal(txn, groupPath+"/member/"+userName)
+	if err != nil || value == nil {
+		return groupRoleNone, err
+	}
+	role, err := parseGroupMember(value)
+	if err != nil {
+		return groupRoleNone, nil // not something we could have written, ignore it
+	}
+	return role, nil
+}
+
+// memberIndexKey is the index entry pointing at a user's membership record memberKey
+func memberIndexKey(userName string, memberKey string) string {
+	return memberIndexPrefix + userName + "/" + memberKey
+}
+
+func (app *AthenaStoreApplication) handleMemberChange(txn KVTxn, memberKey string, value interface{}) error {
+	matches := groupMemberPat.FindStringSubmatch(memberKey)
+	indexKey := memberIndexKey(matches[2], memberKey)
+	if value == nil {
+		return app.storeRaw(txn, indexKey, nil)
+	}
+	encKey, err := ToBadgerType(memberKey)
+	if err != nil {
+		return err
+	}
+	return app.storeRaw(txn, indexKey, encKey)
+}
+
+// hasGroupRole checks whether login (or the user it belongs to) holds at least the specified role in a group
+func (app *AthenaStoreApplication) hasGroupRole(txn KVTxn, login *loginEntry, groupPath string, role int) (bool, error) {
+	if acct, _ := domainUserTypes.MatchFromPath(groupPath); acct == nil || acct.Type != groupUserTypeConfig {
+		return false, nil
+	}
+	apexEntry := login
+	if apexEntry.Parent != nil {
+		apexEntry = apexEntry.Parent
+	}
+	if apexEntry.Type != userUserTypeConfig {
+		return false, nil
+	}
+	held, err := memberRole(txn, groupPath, apexEntry.Name)
+	if err != nil {
+		return false, err
+	}
+	return held >= role, nil
+}
+
+// canCreateGroup checks whether path is the account record of a group that does not yet exist, which any user may found
+func (app *AthenaStoreApplication) canCreateGroup(txn KVTxn, login *loginEntry, path string) (bool, error) {
+	if login.Type != userUserTypeConfig && login.Type != loginUserTypeConfig {
+		return false, nil
+	}
+	if !groupAuthPat.MatchString(path) {
+		return false, nil
+	}
+	existing, err := getBadgerRaw(txn, path)
+	if err != nil {
+		return false, err
+	}
+	return existing == nil, nil
+}
+
+// isNewGroup checks whether writing value to key would found a new group
+func isNewGroup(txn KVTxn, key string, value interface{}) (bool, error) {
+	if value == nil || !groupAuthPat.MatchString(key) {
+		return false, nil
+	}
+	existing, err := getBadgerRaw(txn, key)
+	if err != nil {
+		return false, err
+	}
+	return existing == nil, nil
+}
+
+// addGroupCreator records the user founding a group as its first owner
+func (app *AthenaStoreApplication) addGroupCreator(txn KVTxn, groupAuthKey string, login *loginEntry) ([]abcitypes.Event, error) {
+	apexEntry := login
+	if apexEntry.Parent != nil {
+		apexEntry = apexEntry.Parent
+	}
+	if apexEntry.Type != userUserTypeConfig {
+		return nil, nil // root is not a member of anything, it'll need to add the owners itself
+	}
+	memberKey := groupAuthPat.FindStringSubmatch(groupAuthKey)[1] + "/member/" + apexEntry.Name
+	value := map[string]interface{}{"role": groupRoleNames[groupRoleOwner]}
+	event, err := writeEvent(txn, memberKey, value)
+	if err != nil {
+		return nil, err
+	}
+	err = app.setKey(txn, memberKey, value)
+	if err != nil {
+		return nil, err
+	}
+	return []abcitypes.Event{event}, nil
+}
+
+// checkMemberChange validates a write to a group member record, which may only involve the owner role if made by an owner
+func (app *AthenaStoreApplication) checkMemberChange(txn KVTxn, login *loginEntry, key string, value interface{}) (code uint32, codeDescr string) {
+	matches := groupMemberPat.FindStringSubmatch(key)
+	newRole := groupRoleNone
+	if value != nil {
+		var err error
+		if newRole, err = parseGroupMember(value); err != nil {
+			return ErrorBadFormat, err.Error()
+		}
+	}
+	if login == nil || login.Type == rootUserTypeConfig {
+		return 0, ""
+	}
+	oldRole, err := memberRole(txn, matches[1], matches[2])
+	if err != nil {
+		return ErrorUnexpected, err.Error()
+	}
+	if oldRole != groupRoleOwner && newRole != groupRoleOwner {
+		return 0, ""
+	}
+	isOwner, err := app.hasGroupRole(txn, login, matches[1], groupRoleOwner)
+	if err != nil {
+		return ErrorUnexpected, err.Error()
+	}
+	if !isOwner {
+		return ErrorUnauth, fmt.Sprintf("Only an owner of %s may change its owners", matches[1])
+	}
+	return 0, ""
+}
@@ -0,0 +1,94 @@
+package app
+
+// Implements KVStore on top of a badger database opened in managed mode, where badger versions are ours to assign
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+type badgerStore struct {
+	db *badger.DB
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+type badgerIterator struct {
+	iter *badger.Iterator
+}
+
+// NewBadgerStore wraps a badger database (which must be opened in managed mode) as a KVStore
+func NewBadgerStore(db *badger.DB) KVStore {
+	return &badgerStore{db: db}
+}
+
+func (store *badgerStore) NewTransactionAt(readVersion uint64, update bool) KVTxn {
+	return &badgerTxn{txn: store.db.NewTransactionAt(readVersion, update)}
+}
+
+func (store *badgerStore) SetDiscardVersion(version uint64) {
+	store.db.SetDiscardTs(version)
+}
+
+func (txn *badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := txn.txn.Get(key)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (txn *badgerTxn) Set(key []byte, value []byte) error {
+	return txn.txn.Set(key, value)
+}
+
+func (txn *badgerTxn) Delete(key []byte) error {
+	return txn.txn.Delete(key)
+}
+
+func (txn *badgerTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	badgerOpts := badger.DefaultIteratorOptions
+	badgerOpts.Prefix = opts.Prefix
+	badgerOpts.PrefetchValues = !opts.KeysOnly
+	return &badgerIterator{iter: txn.txn.NewIterator(badgerOpts)}
+}
+
+func (txn *badgerTxn) CommitAt(commitVersion uint64) error {
+	return txn.txn.CommitAt(commitVersion, nil)
+}
+
+func (txn *badgerTxn) Discard() {
+	txn.txn.Discard()
+}
+
+func (iter *badgerIterator) Rewind() {
+	iter.iter.Rewind()
+}
+
+func (iter *badgerIterator) Seek(key []byte) {
+	iter.iter.Seek(key)
+}
+
+func (iter *badgerIterator) Valid() bool {
+	return iter.iter.Valid()
+}
+
+func (iter *badgerIterator) Next() {
+	iter.iter.Next()
+}
+
+func (iter *badgerIterator) Key() []byte {
+	return iter.iter.Item().Key()
+}
+
+func (iter *badgerIterator) Value() ([]byte, error) {
+	return iter.iter.Item().ValueCopy(nil)
+}
+
+func (iter *badgerIterator) Close() {
+	iter.iter.Close()
+}
@@ -0,0 +1,198 @@
+package app
+
+// Implements KVStore in memory, for tests and tools that have no need of a database on disk
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errReadOnlyTxn = errors.New("Transaction was not opened for update")
+
+type memVersion struct {
+	version uint64
+	value   []byte // nil if the key was deleted as of this version
+}
+
+type memStore struct {
+	mtx      sync.RWMutex
+	keys     []string                // every key holding any versions, in order
+	versions map[string][]memVersion // key -> its values, oldest first
+}
+
+type memTxn struct {
+	store       *memStore
+	readVersion uint64
+	update      bool
+	pending     map[string][]byte // writes not yet committed (nil values are deletes)
+}
+
+type memEntry struct {
+	key   string
+	value []byte
+}
+
+type memIterator struct {
+	entries []memEntry
+	pos     int
+}
+
+// NewMemoryStore creates an empty KVStore held in memory
+func NewMemoryStore() KVStore {
+	return &memStore{versions: make(map[string][]memVersion)}
+}
+
+func (store *memStore) NewTransactionAt(readVersion uint64, update bool) KVTxn {
+	return &memTxn{store: store, readVersion: readVersion, update: update, pending: make(map[string][]byte)}
+}
+
+// valueAt returns the value of key as of version (the caller must hold store.mtx)
+func (store *memStore) valueAt(key string, version uint64) []byte {
+	versions := store.versions[key]
+	for idx := len(versions) - 1; idx >= 0; idx-- {
+		if versions[idx].version <= version {
+			return versions[idx].value
+		}
+	}
+	return nil
+}
+
+func (store *memStore) SetDiscardVersion(version uint64) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	keys := store.keys[:0]
+	for _, key := range store.keys {
+		// keep the newest value visible as of version, and anything newer than that
+		versions := store.versions[key]
+		first := 0
+		for idx, entry := range versions {
+			if entry.version <= version {
+				first = idx
+			}
+		}
+		versions = versions[first:]
+		if len(versions) == 1 && versions[0].value == nil && versions[0].version <= version {
+			delete(store.versions, key)
+			continue
+		}
+		store.versions[key] = versions
+		keys = append(keys, key)
+	}
+	store.keys = keys
+}
+
+func (txn *memTxn) Get(key []byte) ([]byte, error) {
+	if value, ok := txn.pending[string(key)]; ok {
+		return copyBytes(value), nil
+	}
+	txn.store.mtx.RLock()
+	defer txn.store.mtx.RUnlock()
+	return copyBytes(txn.store.valueAt(string(key), txn.readVersion)), nil
+}
+
+func (txn *memTxn) Set(key []byte, value []byte) error {
+	if !txn.update {
+		return errReadOnlyTxn
+	}
+	txn.pending[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (txn *memTxn) Delete(key []byte) error {
+	if !txn.update {
+		return errReadOnlyTxn
+	}
+	txn.pending[string(key)] = nil
+	return nil
+}
+
+func (txn *memTxn) NewIterator(opts KVIteratorOptions) KVIterator {
+	prefix := string(opts.Prefix)
+	values := make(map[string][]byte)
+
+	txn.store.mtx.RLock()
+	keys := txn.store.keys
+	for idx := sort.SearchStrings(keys, prefix); idx < len(keys) && strings.HasPrefix(keys[idx], prefix); idx++ {
+		values[keys[idx]] = txn.store.valueAt(keys[idx], txn.readVersion)
+	}
+	txn.store.mtx.RUnlock()
+	for key, value := range txn.pending {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = value
+		}
+	}
+
+	iter := &memIterator{entries: make([]memEntry, 0, len(values))}
+	for key, value := range values {
+		if value != nil {
+			iter.entries = append(iter.entries, memEntry{key: key, value: value})
+		}
+	}
+	sort.Slice(iter.entries, func(i, j int) bool { return iter.entries[i].key < iter.entries[j].key })
+	return iter
+}
+
+func (txn *memTxn) CommitAt(commitVersion uint64) error {
+	if !txn.update {
+		return errReadOnlyTxn
+	}
+	txn.store.mtx.Lock()
+	defer txn.store.mtx.Unlock()
+	for key, value := range txn.pending {
+		versions, ok := txn.store.versions[key]
+		if !ok {
+			idx := sort.SearchStrings(txn.store.keys, key)
+			txn.store.keys = append(txn.store.keys, "")
+			copy(txn.store.keys[idx+1:], txn.store.keys[idx:])
+			txn.store.keys[idx] = key
+		}
+		idx := sort.Search(len(versions), func(i int) bool { return versions[i].version > commitVersion })
+		versions = append(versions, memVersion{})
+		copy(versions[idx+1:], versions[idx:])
+		versions[idx] = memVersion{version: commitVersion, value: value}
+		txn.store.versions[key] = versions
+	}
+	txn.pending = make(map[string][]byte)
+	return nil
+}
+
+func (txn *memTxn) Discard() {
+	txn.pending = make(map[string][]byte)
+}
+
+func (iter *memIterator) Rewind() {
+	iter.pos = 0
+}
+
+func (iter *memIterator) Seek(key []byte) {
+	iter.pos = sort.Search(len(iter.entries), func(i int) bool { return iter.entries[i].key >= string(key) })
+}
+
+func (iter *memIterator) Valid() bool {
+	return iter.pos < len(iter.entries)
+}
+
+func (iter *memIterator) Next() {
+	iter.pos++
+}
+
+func (iter *memIterator) Key() []byte {
+	return []byte(iter.entries[iter.pos].key)
+}
+
+func (iter *memIterator) Value() ([]byte, error) {
+	return copyBytes(iter.entries[iter.pos].value), nil
+}
+
+func (iter *memIterator) Close() {
+	iter.entries = nil
+}
+
+func copyBytes(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
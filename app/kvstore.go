@@ -0,0 +1,54 @@
+package app
+
+// Defines the key-value store the application keeps its state in.  The store is versioned: a transaction reads the
+// store as it stood at some version and, if opened for update, its writes become a later version when committed.  We
+// use the badger version of block N as heightVersion(N), see kvstore-badger.go and kvstore-memory.go for the
+// implementations
+
+// KVStore is a versioned key-value store
+type KVStore interface {
+	// NewTransactionAt opens a view of the store as of readVersion, which may be written to if update is set
+	NewTransactionAt(readVersion uint64, update bool) KVTxn
+	// SetDiscardVersion permits the store to discard anything only visible to versions older than the one specified
+	SetDiscardVersion(version uint64)
+}
+
+// KVTxn is a view of a KVStore, along with any writes made through it
+type KVTxn interface {
+	// Get returns the value stored at key, or nil if there is none
+	Get(key []byte) ([]byte, error)
+	// Set stores a value at key
+	Set(key []byte, value []byte) error
+	// Delete removes whatever is stored at key
+	Delete(key []byte) error
+	// NewIterator walks the keys of this view in byte order
+	NewIterator(opts KVIteratorOptions) KVIterator
+	// CommitAt writes everything set or deleted through this view to the store as of commitVersion
+	CommitAt(commitVersion uint64) error
+	// Discard releases this view, abandoning anything not yet committed
+	Discard()
+}
+
+// KVIteratorOptions describes what a KVIterator should visit
+type KVIteratorOptions struct {
+	Prefix   []byte // only keys beginning with this are visited
+	KeysOnly bool   // the values will not be needed (the store need not prefetch them)
+}
+
+// KVIterator walks the keys of a KVTxn, it must be closed once finished with
+type KVIterator interface {
+	// Rewind moves to the first key
+	Rewind()
+	// Seek moves to the first key at or after key (the first key if key is empty)
+	Seek(key []byte)
+	// Valid returns false once there are no more keys to visit
+	Valid() bool
+	// Next moves to the next key
+	Next()
+	// Key returns the current key, which may only be used until the iterator is moved
+	Key() []byte
+	// Value returns a copy of the value at the current key
+	Value() ([]byte, error)
+	// Close releases the iterator
+	Close()
+}
@@ -4,6 +4,8 @@ package app
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"path/filepath"
@@ -32,8 +34,14 @@ import (
 // FirstCycleComplete, if non-nil, will be closed when the next block is committed
 var FirstCycleComplete chan struct{}
 
+// InitOptions controls how DoInit declares the root user of a new chain
+type InitOptions struct {
+	RootKeyFile string // file holding the root user's key, generated if it does not exist
+	RootPubKey  string // public key (base64url) of an existing root user, used instead of RootKeyFile
+}
+
 // DoInit creates the necessary files to create a new tendermint chain
-func DoInit(config *cfg.Config, logger tmlog.Logger) error {
+func DoInit(config *cfg.Config, opts InitOptions, logger tmlog.Logger) error {
 	// private validator
 	privValKeyFile := config.PrivValidatorKeyFile()
 	privValStateFile := config.PrivValidatorStateFile()
@@ -76,10 +84,33 @@ func DoInit(config *cfg.Config, logger tmlog.Logger) error {
 	if tmos.FileExists(genFile) {
 		logger.Info("Found genesis file", "path", genFile)
 	} else {
+		rootPubKey := opts.RootPubKey
+		if rootPubKey == "" {
+			rootKeyFile := opts.RootKeyFile
+			if rootKeyFile == "" {
+				rootKeyFile = filepath.Join(filepath.Dir(nodeKeyFile), "root_key.json")
+			}
+			pubKey, generated, err := LoadOrGenRootKey(rootKeyFile)
+			if err != nil {
+				return err
+			}
+			if generated {
+				logger.Info("Generated root key", "path", rootKeyFile)
+			} else {
+				logger.Info("Found root key", "path", rootKeyFile)
+			}
+			rootPubKey = base64.RawURLEncoding.EncodeToString(pubKey)
+		}
+		appState, err := json.Marshal(GenesisState{RootPubKey: rootPubKey})
+		if err != nil {
+			return errors.Wrap(err, "failed to construct genesis app_state")
+		}
+
 		genDoc := types.GenesisDoc{
 			ChainID:         fmt.Sprintf("athenamesh-%v", tmrand.Str(6)),
 			GenesisTime:     tmtime.Now(),
 			ConsensusParams: types.DefaultConsensusParams(),
+			AppState:        appState,
 		}
 		key, err := pv.GetPubKey()
 		if err != nil {
@@ -99,6 +130,10 @@ func DoInit(config *cfg.Config, logger tmlog.Logger) error {
 
 	configFile := filepath.Join(filepath.Dir(nodeKeyFile), "config.toml")
 	if !tmos.FileExists(configFile) {
+		if config.TxIndex.IndexKeys == "" && !config.TxIndex.IndexAllKeys {
+			// index the attributes of our events that clients would want to search by
+			config.TxIndex.IndexKeys = strings.Join(IndexedEventKeys, ",")
+		}
 		cfg.WriteConfigFile(configFile, config)
 		logger.Info("Generated config file", "path", configFile)
 	}
@@ -110,11 +145,19 @@ func DoInit(config *cfg.Config, logger tmlog.Logger) error {
 	return nil
 }
 
+// AppConfig holds the settings specific to athenamesh, read from the [athenamesh] section of config.toml
+type AppConfig struct {
+	RetainBlocks       int64 `mapstructure:"retain_blocks"`        // number of past blocks available to historical queries (0 = keep all)
+	SnapshotInterval   int64 `mapstructure:"snapshot_interval"`    // blocks between state-sync snapshots (0 = take none)
+	SnapshotKeepRecent int64 `mapstructure:"snapshot_keep_recent"` // number of snapshots to keep (0 = keep all)
+}
+
 type tendermintFullNode struct {
-	config *cfg.Config
-	logger tmlog.Logger
-	app    abcitypes.Application
-	dbopt  *badger.Options
+	config    *cfg.Config
+	appConfig AppConfig
+	logger    tmlog.Logger
+	app       abcitypes.Application
+	dbopt     *badger.Options
 
 	db   *badger.DB
 	node *nm.Node
@@ -133,6 +176,9 @@ func (node *tendermintFullNode) readAppConfig(configFile string) error {
 	if err := node.config.ValidateBasic(); err != nil {
 		return errors.Wrap(err, "config is invalid")
 	}
+	if err := viper.UnmarshalKey("athenamesh", &node.appConfig); err != nil {
+		return errors.Wrap(err, "viper failed to unmarshal athenamesh config")
+	}
 
 	// create logger
 	var err error
@@ -184,29 +230,63 @@ func (node *tendermintFullNode) prepareNode() error {
 		return err
 	}
 
-	dbPath := filepath.Join(filepath.Dir(node.config.PrivValidatorStateFile()), "store.db")
-	dbopt := badger.DefaultOptions(dbPath)
+	dbopt := storeOptions(node.config, node.logger)
 	node.dbopt = &dbopt
-	badgerLogger := newBadgerLogger(node.logger)
-	node.dbopt.Logger = badgerLogger
-	if strings.HasPrefix(runtime.GOOS, "windows") {
-		dbopt = node.dbopt.WithTruncate(true)
-		node.dbopt = &dbopt
-	}
-	node.app = NewAthenaStoreApplication(nil, node.logger)
+	athenaApp := NewAthenaStoreApplication(nil, node.appConfig, node.logger)
+	athenaApp.snapshots = newSnapshotStore(snapshotDir(node.config), node.appConfig.SnapshotKeepRecent)
+	node.app = athenaApp
 
 	err = node.instantiateApp()
 
 	return err
 }
 
+// storeOptions returns the options to open store.db with, which is kept alongside the private validator state
+func storeOptions(config *cfg.Config, logger tmlog.Logger) badger.Options {
+	dbPath := filepath.Join(filepath.Dir(config.PrivValidatorStateFile()), "store.db")
+	dbopt := badger.DefaultOptions(dbPath)
+	dbopt.Logger = newBadgerLogger(logger)
+	if strings.HasPrefix(runtime.GOOS, "windows") {
+		dbopt = dbopt.WithTruncate(true)
+	}
+	return dbopt
+}
+
+// snapshotDir returns the directory holding our state-sync snapshots, which is kept beside store.db
+func snapshotDir(config *cfg.Config) string {
+	return filepath.Join(filepath.Dir(config.PrivValidatorStateFile()), "snapshots")
+}
+
+// openToolStore reads config.toml and opens store.db, for commands that work on the store while the node is stopped
+func openToolStore(config *cfg.Config, logger tmlog.Logger) (*badger.DB, error) {
+	node := &tendermintFullNode{
+		config: config,
+		logger: logger,
+	}
+	err := node.readAppConfig(filepath.Join(filepath.Dir(config.NodeKeyFile()), "config.toml"))
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.OpenManaged(storeOptions(node.config, node.logger))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open badger db")
+	}
+	return db, nil
+}
+
 func (node *tendermintFullNode) Start(ctx context.Context) error {
 	var err error
-	node.db, err = badger.Open(*node.dbopt)
+	node.db, err = badger.OpenManaged(*node.dbopt)
 	if err != nil {
 		return errors.Wrap(err, "failed to open badger db")
 	}
-	node.app.(*AthenaStoreApplication).db = node.db
+	store := NewBadgerStore(node.db)
+	if _, err = migrateStore(store, false, node.logger); err != nil {
+		return errors.Wrap(err, "failed to migrate store.db")
+	}
+	athenaApp := node.app.(*AthenaStoreApplication)
+	athenaApp.db = store
+	athenaApp.init()
 
 	err = node.node.Start()
 	if err != nil {
@@ -224,6 +304,10 @@ func (node *tendermintFullNode) Stop(ctx context.Context) (err error) {
 		node.node = nil
 	}
 
+	if athenaApp, ok := node.app.(*AthenaStoreApplication); ok && athenaApp.snapshots != nil {
+		// a snapshot may still be reading from the store
+		athenaApp.snapshots.wait()
+	}
 	if node.db != nil {
 		err2 := node.db.Close()
 		if err2 != nil {
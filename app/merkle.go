@@ -0,0 +1,380 @@
+package app
+
+// Maintains a sparse Merkle tree over every key in the store so that the application can report (and later prove) a
+// hash of its entire state.  Leaves are positioned by the sha256 of their key; a subtree holding a single leaf is
+// collapsed into that leaf so that the shape of the tree depends only on its contents and not on the order of updates
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tendermint/tendermint/crypto/merkle"
+)
+
+// ProofOpMerkle is the ProofOp type used for proofs against our merkle tree
+const ProofOpMerkle = "athena:smt"
+
+const (
+	merkleLeafNode  byte = 0
+	merkleInnerNode      = 1
+
+	merkleNodePrefix = "mesh/merkle/" // where the tree nodes are stored, keyed by their hash
+	merkleMaxDepth   = sha256.Size * 8
+)
+
+var emptyMerkleHash = make([]byte, sha256.Size)
+
+type merkleNode struct {
+	isLeaf bool
+	left   []byte // key hash for a leaf
+	right  []byte // value hash for a leaf
+}
+
+func (node *merkleNode) encode() []byte {
+	var nodeType byte = merkleInnerNode
+	if node.isLeaf {
+		nodeType = merkleLeafNode
+	}
+	return append(append([]byte{nodeType}, node.left...), node.right...)
+}
+
+func (node *merkleNode) hash() []byte {
+	hash := sha256.Sum256(node.encode())
+	return hash[:]
+}
+
+func decodeMerkleNode(enc []byte) (*merkleNode, error) {
+	if len(enc) != 1+2*sha256.Size {
+		return nil, errors.New("merkle node has unexpected length")
+	}
+	switch enc[0] {
+	case merkleLeafNode, merkleInnerNode:
+		return &merkleNode{
+			isLeaf: enc[0] == merkleLeafNode,
+			left:   enc[1 : 1+sha256.Size],
+			right:  enc[1+sha256.Size:],
+		}, nil
+	default:
+		return nil, fmt.Errorf("merkle node has unexpected type %d", enc[0])
+	}
+}
+
+func isEmptyMerkleHash(hash []byte) bool {
+	return len(hash) == 0 || bytes.Equal(hash, emptyMerkleHash)
+}
+
+// merkleBit returns the direction to take at the specified depth when descending towards keyHash (true = right)
+func merkleBit(keyHash []byte, depth int) bool {
+	return keyHash[depth/8]&(0x80>>uint(depth%8)) != 0
+}
+
+func merkleKeyHash(key string) []byte {
+	hash := sha256.Sum256([]byte(key))
+	return hash[:]
+}
+
+func merkleValueHash(value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return hash[:]
+}
+
+type merkleTree struct {
+	txn KVTxn
+}
+
+func (tree *merkleTree) getNode(hash []byte) (*merkleNode, error) {
+	gNode, err := GetBadgerVal(tree.txn, merkleNodePrefix+string(hash))
+	if err != nil {
+		return nil, err
+	}
+	if gNode == nil {
+		return nil, fmt.Errorf("merkle node %x is missing from the store", hash)
+	}
+	enc, ok := gNode.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("merkle node %x has unexpected type", hash)
+	}
+	return decodeMerkleNode(enc)
+}
+
+func (tree *merkleTree) putNode(node *merkleNode) ([]byte, error) {
+	hash := node.hash()
+	encData, err := ToBadgerType(node.encode())
+	if err != nil {
+		return nil, err
+	}
+	return hash, tree.txn.Set([]byte(merkleNodePrefix+string(hash)), encData)
+}
+
+func (tree *merkleTree) deleteNode(hash []byte) error {
+	return tree.txn.Delete([]byte(merkleNodePrefix + string(hash)))
+}
+
+// update sets (or removes, if valueHash is nil) the leaf for keyHash in the subtree rooted at nodeHash, returning the new subtree hash
+func (tree *merkleTree) update(nodeHash []byte, depth int, keyHash []byte, valueHash []byte) ([]byte, error) {
+	if isEmptyMerkleHash(nodeHash) {
+		if valueHash == nil {
+			return emptyMerkleHash, nil // nothing to remove
+		}
+		return tree.putNode(&merkleNode{isLeaf: true, left: keyHash, right: valueHash})
+	}
+
+	node, err := tree.getNode(nodeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.isLeaf {
+		if bytes.Equal(node.left, keyHash) {
+			if bytes.Equal(node.right, valueHash) {
+				return nodeHash, nil // no change
+			}
+			err = tree.deleteNode(nodeHash)
+			if err != nil {
+				return nil, err
+			}
+			if valueHash == nil {
+				return emptyMerkleHash, nil
+			}
+			return tree.putNode(&merkleNode{isLeaf: true, left: keyHash, right: valueHash})
+		}
+		if valueHash == nil {
+			return nodeHash, nil // the key we're removing isn't here
+		}
+
+		// we've found a different leaf, push both of them down until their paths split
+		newLeaf, err := tree.putNode(&merkleNode{isLeaf: true, left: keyHash, right: valueHash})
+		if err != nil {
+			return nil, err
+		}
+		return tree.join(nodeHash, node.left, newLeaf, keyHash, depth)
+	}
+
+	left, right := node.left, node.right
+	if merkleBit(keyHash, depth) {
+		right, err = tree.update(right, depth+1, keyHash, valueHash)
+	} else {
+		left, err = tree.update(left, depth+1, keyHash, valueHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(left, node.left) && bytes.Equal(right, node.right) {
+		return nodeHash, nil // no change
+	}
+	err = tree.deleteNode(nodeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// if we're left with a single leaf then it replaces us
+	if isEmptyMerkleHash(left) && isEmptyMerkleHash(right) {
+		return emptyMerkleHash, nil
+	}
+	if isEmptyMerkleHash(left) || isEmptyMerkleHash(right) {
+		remain := left
+		if isEmptyMerkleHash(left) {
+			remain = right
+		}
+		remainNode, err := tree.getNode(remain)
+		if err != nil {
+			return nil, err
+		}
+		if remainNode.isLeaf {
+			return remain, nil
+		}
+	}
+	return tree.putNode(&merkleNode{left: left, right: right})
+}
+
+// join creates the inner nodes needed to hold two leaves that both fall under the same path at the specified depth
+func (tree *merkleTree) join(aHash []byte, aKey []byte, bHash []byte, bKey []byte, depth int) ([]byte, error) {
+	if depth >= merkleMaxDepth {
+		return nil, errors.New("Unexpected: two distinct merkle leaves share the same key hash")
+	}
+	aBit := merkleBit(aKey, depth)
+	if aBit == merkleBit(bKey, depth) {
+		child, err := tree.join(aHash, aKey, bHash, bKey, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if aBit {
+			return tree.putNode(&merkleNode{left: emptyMerkleHash, right: child})
+		}
+		return tree.putNode(&merkleNode{left: child, right: emptyMerkleHash})
+	}
+	if aBit {
+		return tree.putNode(&merkleNode{left: bHash, right: aHash})
+	}
+	return tree.putNode(&merkleNode{left: aHash, right: bHash})
+}
+
+// prove collects the sibling hashes along the path to keyHash, along with whatever node terminates that path
+// (nil if the path ends in an empty subtree)
+func (tree *merkleTree) prove(root []byte, keyHash []byte) ([][]byte, *merkleNode, error) {
+	siblings := make([][]byte, 0)
+	nodeHash := root
+	for depth := 0; !isEmptyMerkleHash(nodeHash); depth++ {
+		node, err := tree.getNode(nodeHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if node.isLeaf {
+			return siblings, node, nil
+		}
+		if merkleBit(keyHash, depth) {
+			siblings = append(siblings, node.left)
+			nodeHash = node.right
+		} else {
+			siblings = append(siblings, node.right)
+			nodeHash = node.left
+		}
+	}
+	return siblings, nil, nil
+}
+
+// MerkleProofOp proves the presence (or absence) of a single key in the application's merkle tree
+type MerkleProofOp struct {
+	Key           []byte   `json:"-"`                       // the resolved key this proof is for
+	Siblings      [][]byte `json:"siblings"`                // sibling hashes from the root down to the position of the key
+	LeafKeyHash   []byte   `json:"leafKeyHash,omitempty"`   // (absence) the key hash of a different leaf occupying that position
+	LeafValueHash []byte   `json:"leafValueHash,omitempty"` // (absence) the value hash of a different leaf occupying that position
+}
+
+var _ merkle.ProofOperator = (*MerkleProofOp)(nil)
+
+// MerkleProofOpDecoder decodes a ProofOp of type ProofOpMerkle, for registration with a merkle.ProofRuntime
+func MerkleProofOpDecoder(pop merkle.ProofOp) (merkle.ProofOperator, error) {
+	if pop.Type != ProofOpMerkle {
+		return nil, fmt.Errorf("unexpected ProofOp.Type; got %s, want %s", pop.Type, ProofOpMerkle)
+	}
+	op := &MerkleProofOp{}
+	if err := json.Unmarshal(pop.Data, op); err != nil {
+		return nil, err
+	}
+	op.Key = pop.Key
+	return op, nil
+}
+
+// GetKey returns the key this proof is for
+func (op *MerkleProofOp) GetKey() []byte {
+	return op.Key
+}
+
+// ProofOp encodes this proof for transmission
+func (op *MerkleProofOp) ProofOp() merkle.ProofOp {
+	data, _ := json.Marshal(op) // cannot fail, all fields are byte slices
+	return merkle.ProofOp{Type: ProofOpMerkle, Key: op.Key, Data: data}
+}
+
+// Run computes the root hash from the stored value passed in args (or proves absence if args is empty)
+func (op *MerkleProofOp) Run(args [][]byte) ([][]byte, error) {
+	if len(op.Siblings) > merkleMaxDepth {
+		return nil, errors.New("merkle proof is too long")
+	}
+	keyHash := merkleKeyHash(string(op.Key))
+	var nodeHash []byte
+	switch len(args) {
+	case 0:
+		if len(op.LeafKeyHash) == 0 {
+			nodeHash = emptyMerkleHash
+		} else {
+			if len(op.LeafKeyHash) != sha256.Size || len(op.LeafValueHash) != sha256.Size || bytes.Equal(op.LeafKeyHash, keyHash) {
+				return nil, errors.New("merkle absence proof has an invalid leaf")
+			}
+			for depth := range op.Siblings {
+				if merkleBit(op.LeafKeyHash, depth) != merkleBit(keyHash, depth) {
+					return nil, errors.New("merkle absence proof has a leaf on a different path")
+				}
+			}
+			nodeHash = (&merkleNode{isLeaf: true, left: op.LeafKeyHash, right: op.LeafValueHash}).hash()
+		}
+	case 1:
+		if len(op.LeafKeyHash) != 0 {
+			return nil, errors.New("merkle value proof should not have a leaf")
+		}
+		nodeHash = (&merkleNode{isLeaf: true, left: keyHash, right: merkleValueHash(args[0])}).hash()
+	default:
+		return nil, fmt.Errorf("expected at most one value, got %d", len(args))
+	}
+
+	for depth := len(op.Siblings) - 1; depth >= 0; depth-- {
+		sibling := op.Siblings[depth]
+		if len(sibling) != sha256.Size {
+			return nil, errors.New("merkle proof has an invalid sibling")
+		}
+		if merkleBit(keyHash, depth) {
+			nodeHash = (&merkleNode{left: sibling, right: nodeHash}).hash()
+		} else {
+			nodeHash = (&merkleNode{left: nodeHash, right: sibling}).hash()
+		}
+	}
+	return [][]byte{nodeHash}, nil
+}
+
+// proveKey constructs a proof against the specified app hash for the specified (resolved) key
+func proveKey(txn KVTxn, root []byte, key string) (*merkle.Proof, error) {
+	if len(root) == 0 {
+		root = emptyMerkleHash
+	}
+	tree := &merkleTree{txn: txn}
+	keyHash := merkleKeyHash(key)
+	siblings, leaf, err := tree.prove(root, keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &MerkleProofOp{Key: []byte(key), Siblings: siblings}
+	if leaf != nil && !bytes.Equal(leaf.left, keyHash) {
+		op.LeafKeyHash = leaf.left
+		op.LeafValueHash = leaf.right
+	}
+	return &merkle.Proof{Ops: []merkle.ProofOp{op.ProofOp()}}, nil
+}
+
+// isMerkleKey returns whether a key in the store is covered by the application hash (our own bookkeeping is not)
+func isMerkleKey(key string) bool {
+	return !strings.HasPrefix(key, "mesh/")
+}
+
+// updateAppHash folds all keys changed since the last call into the merkle tree and records the new root
+func (app *AthenaStoreApplication) updateAppHash(txn KVTxn) error {
+	keys := make([]string, 0, len(app.dirtyKeys))
+	for key := range app.dirtyKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tree := &merkleTree{txn: txn}
+	root := app.treeState.lastBlockHash
+	if len(root) == 0 {
+		root = emptyMerkleHash
+	}
+	for _, key := range keys {
+		value, err := getBadgerRaw(txn, key)
+		if err != nil {
+			return err
+		}
+		var valueHash []byte
+		if value != nil {
+			// we can only agree on a hash with other nodes if we agree on how the value is encoded
+			if err = checkCanonical(value); err != nil {
+				return fmt.Errorf("%s: %s", key, err.Error())
+			}
+			valueHash = merkleValueHash(value)
+		}
+		root, err = tree.update(root, 0, merkleKeyHash(key), valueHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.dirtyKeys = make(map[string]struct{})
+	app.treeState.lastBlockHash = root
+	return nil
+}
@@ -0,0 +1,304 @@
+package app
+
+// Tracks the layout of store.db with a schema version kept at mesh/schemaVersion, and brings older stores up to date
+// when the node starts.  Each migration is run once, in order, against the state as of the last committed block; the
+// migrations still due all run in a single transaction along with the new schema version, so a store is never left
+// partly migrated.  A migration must leave the keys covered by the app hash alone (every node has to agree on them),
+// changes there belong in transactions.
+//
+// Stores from before the app hash covered the whole state (and before values were encoded canonically) cannot be
+// upgraded in place, as their app hash would change.  The node refuses to start on one; export its state instead and
+// start a new chain from the dump.
+//
+// Schema versions:
+//   0 - stores from before the version was tracked
+//   1 - bookkeeping under mesh/ stored in canonical encoding (as the keys covered by the app hash already are)
+//   2 - group memberships and grants indexed by the account they name (mesh/memberOf/ and mesh/grantee/)
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	cfg "github.com/tendermint/tendermint/config"
+	tmlog "github.com/tendermint/tendermint/libs/log"
+)
+
+const schemaVersionKey = "mesh/schemaVersion"
+
+type migration struct {
+	version int64                                         // schema version of the store once this migration has run
+	descr   string                                        // what the migration does, for the log
+	apply   func(txn KVTxn, logChange func(string)) error // makes the changes, reporting each one
+}
+
+// migrations is every migration there is, in the order they must be run
+var migrations = []migration{
+	{1, "re-encode bookkeeping under mesh/ in canonical form", migrateCanonicalBookkeeping},
+	{2, "index group memberships and grants by account", migrateAccountReferenceIndex},
+}
+
+// currentSchemaVersion is the layout this build reads and writes
+var currentSchemaVersion = migrations[len(migrations)-1].version
+
+// MigrateOptions controls what DoMigrate does
+type MigrateOptions struct {
+	Check bool // report the migrations that are due and what they would change, without changing anything
+}
+
+// readSchemaVersion returns the schema version of the store, or -1 if it holds nothing at all
+func readSchemaVersion(txn KVTxn) (int64, error) {
+	val, err := GetBadgerVal(txn, schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if val != nil {
+		version, ok := NumberToInt64(val)
+		if !ok {
+			return 0, fmt.Errorf("Unexpected schema version %v", val)
+		}
+		return version, nil
+	}
+	blockState, err := getBadgerRaw(txn, "mesh/blockState")
+	if err != nil {
+		return 0, err
+	}
+	if blockState == nil {
+		return -1, nil
+	}
+	return 0, nil
+}
+
+// migrateStore brings the store up to currentSchemaVersion, returning the number of migrations that were due.  With
+// dryRun set nothing is committed, the changes are only reported
+func migrateStore(db KVStore, dryRun bool, logger tmlog.Logger) (int, error) {
+	readTxn := db.NewTransactionAt(math.MaxUint64, false)
+	state, err := readBlockState(readTxn)
+	readTxn.Discard()
+	if err != nil {
+		return 0, err
+	}
+	version := heightVersion(state.lastBlockHeight)
+	txn := db.NewTransactionAt(version, true)
+	defer txn.Discard()
+
+	schemaVersion, err := readSchemaVersion(txn)
+	if err != nil {
+		return 0, err
+	}
+	if schemaVersion > currentSchemaVersion {
+		return 0, fmt.Errorf("store.db has schema version %d, which is newer than this build understands (%d)",
+			schemaVersion, currentSchemaVersion)
+	}
+	if schemaVersion == 0 {
+		if err = checkLegacyStore(txn, state); err != nil {
+			return 0, err
+		}
+	}
+	var due []migration
+	if schemaVersion < 0 {
+		// a new store starts out with the current layout
+		schemaVersion = currentSchemaVersion
+	} else {
+		for _, step := range migrations {
+			if step.version > schemaVersion {
+				due = append(due, step)
+			}
+		}
+	}
+
+	for _, step := range due {
+		logger.Info(fmt.Sprintf("migrating store.db to schema version %d: %s", step.version, step.descr))
+		changes := 0
+		err = step.apply(txn, func(change string) {
+			changes++
+			logger.Info("  " + change)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("schema version %d: %s", step.version, err.Error())
+		}
+		logger.Info(fmt.Sprintf("schema version %d: %d change(s)", step.version, changes))
+		schemaVersion = step.version
+	}
+	if dryRun {
+		return len(due), nil
+	}
+
+	encVersion, err := ToBadgerType(schemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	existing, err := getBadgerRaw(txn, schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(due) == 0 && existing != nil {
+		return 0, nil
+	}
+	err = txn.Set([]byte(schemaVersionKey), encVersion)
+	if err == nil {
+		err = txn.CommitAt(version)
+	}
+	return len(due), err
+}
+
+// checkLegacyStore makes sure a store from before the schema version was tracked is one this build can carry on from:
+// every key covered by the app hash must be canonically encoded and already folded into the merkle tree
+func checkLegacyStore(txn KVTxn, state *treeStateData) error {
+	tree := &merkleTree{txn: txn}
+	root := state.lastBlockHash
+	if len(root) == 0 {
+		root = emptyMerkleHash
+	}
+	iter := txn.NewIterator(KVIteratorOptions{})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if !isMerkleKey(key) {
+			continue
+		}
+		value, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		problem := ""
+		if err = checkCanonical(value); err != nil {
+			problem = err.Error()
+		} else {
+			_, leaf, err := tree.prove(root, merkleKeyHash(key))
+			if err != nil || leaf == nil || !bytes.Equal(leaf.left, merkleKeyHash(key)) ||
+				!bytes.Equal(leaf.right, merkleValueHash(value)) {
+				problem = "not covered by the app hash"
+			}
+		}
+		if problem != "" {
+			return fmt.Errorf("store.db predates the app hash covering the whole state (%s: %s) and cannot be "+
+				"upgraded in place, export its state and start a new chain from the dump", key, problem)
+		}
+	}
+	return nil
+}
+
+// migrateCanonicalBookkeeping rewrites anything under mesh/ stored before the encoding was made canonical (stores whose
+// keys covered by the app hash are not canonical are turned away by checkLegacyStore)
+func migrateCanonicalBookkeeping(txn KVTxn, logChange func(string)) error {
+	type rewrite struct {
+		key   string
+		value []byte
+	}
+	var rewrites []rewrite
+
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte("mesh/")})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if strings.HasPrefix(key, merkleNodePrefix) {
+			continue // tree nodes are not documents
+		}
+		value, err := iter.Value()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if checkCanonical(value) == nil {
+			continue
+		}
+		decoded, err := fromBadgerType(value)
+		if err == nil {
+			value, err = ToBadgerType(decoded)
+		}
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+		rewrites = append(rewrites, rewrite{key: key, value: value})
+	}
+	iter.Close()
+
+	for _, entry := range rewrites {
+		logChange("re-encode " + entry.key)
+		if err := txn.Set([]byte(entry.key), entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAccountReferenceIndex indexes the group memberships and grants written before they were indexed as they were
+// written (see handleMemberChange and handleGrantChange)
+func migrateAccountReferenceIndex(txn KVTxn, logChange func(string)) error {
+	indexEntries := make(map[string]string)
+
+	iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte("group/"), KeysOnly: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if matches := groupMemberPat.FindStringSubmatch(key); matches != nil {
+			indexEntries[memberIndexKey(matches[2], key)] = key
+		}
+	}
+	iter.Close()
+
+	iter = txn.NewIterator(KVIteratorOptions{Prefix: []byte("user/")})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if !grantPat.MatchString(key) {
+			continue
+		}
+		value, err := iter.Value()
+		if err == nil {
+			var grant interface{}
+			if grant, err = fromBadgerType(value); err == nil {
+				if grantee := grantGrantee(grant); grantee != "" {
+					indexEntries[granteeIndexKey(grantee, key)] = key
+				}
+			}
+		}
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+	}
+	iter.Close()
+
+	indexKeys := make([]string, 0, len(indexEntries))
+	for indexKey := range indexEntries {
+		indexKeys = append(indexKeys, indexKey)
+	}
+	sort.Strings(indexKeys)
+	for _, indexKey := range indexKeys {
+		encKey, err := ToBadgerType(indexEntries[indexKey])
+		if err != nil {
+			return err
+		}
+		logChange("index " + indexEntries[indexKey])
+		if err = txn.Set([]byte(indexKey), encKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DoMigrate brings store.db up to the current schema version (as the node does when it starts), or with opts.Check
+// reports what that would change
+func DoMigrate(config *cfg.Config, opts MigrateOptions, logger tmlog.Logger) error {
+	db, err := openToolStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	due, err := migrateStore(NewBadgerStore(db), opts.Check, logger)
+	if err != nil {
+		return err
+	}
+	switch {
+	case due == 0:
+		logger.Info(fmt.Sprintf("store.db is at the current schema version (%d)", currentSchemaVersion))
+	case opts.Check:
+		logger.Info(fmt.Sprintf("%d migration(s) would bring store.db to schema version %d, nothing was changed", due, currentSchemaVersion))
+	default:
+		logger.Info(fmt.Sprintf("store.db migrated to schema version %d", currentSchemaVersion))
+	}
+	return nil
+}
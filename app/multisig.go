@@ -0,0 +1,160 @@
+package app
+
+// Handles accounts controlled by several keys, such as a root user or a domain too valuable to trust to a single key.
+// Rather than a pubKey, the account record of such an account holds:
+//   pubKeys   - list of the keys that may sign for the account
+//   threshold - number of those keys that must sign each transaction (or query) made by the account
+// These accounts have no entry in keyMap/, so their transactions use an envelope naming the account they act for:
+//   marker    - 32 zero bytes, where a single-signature transaction would carry its pubkey
+//   count     - number of signatures that follow (1 byte)
+//   signature - count entries, each a pubkey (32 bytes) then its signature (64 bytes) of MultiSigTxSignBytes
+//   pathLen   - length of the account path (2 bytes, big endian)
+//   acctPath  - path of the account the transaction acts for (such as config/rootUser)
+//   nonce     - nonce of the account (8 bytes, big endian), followed by the body as in any other transaction
+// A signed query carries the fields from marker to acctPath as its data, each key signing MultiSigQuerySignBytes.
+// A multi-signature account cannot sign for child accounts (logins and domains) of its own
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maxMultiSigKeys is the most keys an account may hold (and so the most signatures an envelope may carry)
+const maxMultiSigKeys = 16
+
+var multiSigMarker = make([]byte, ed25519.PublicKeySize)
+
+var errUnknownAccount = errors.New("Did not recognize the multi-signature account")
+
+var errNotEnoughSigners = errors.New("Not enough of the account's keys signed")
+
+type multiSigAuth struct {
+	acctPath string
+	signers  []ed25519.PublicKey
+}
+
+// MultiSigTxSignBytes returns the message signed by each key of a multi-signature transaction
+func MultiSigTxSignBytes(chainID string, acctPath string, nonceAndBody []byte) []byte {
+	msg := append([]byte(chainID), 0)
+	msg = append(append(append(msg, "multisig:"...), acctPath...), 0)
+	return append(msg, nonceAndBody...)
+}
+
+// MultiSigQuerySignBytes returns the message signed by each key of a multi-signature query, which like a transaction
+// names the chain so that it cannot be replayed on another
+func MultiSigQuerySignBytes(chainID string, acctPath string, queryPath string) []byte {
+	return []byte(chainID + "\x00" + "multisig:" + acctPath + "\x00" + queryPath)
+}
+
+// PackMultiSig returns the envelope naming acctPath and carrying the signatures of its keys, which precedes the
+// nonce and body of a transaction or forms the data of a query
+func PackMultiSig(acctPath string, pubKeys []ed25519.PublicKey, signs [][]byte) []byte {
+	data := append([]byte{}, multiSigMarker...)
+	data = append(data, byte(len(pubKeys)))
+	for idx, pubKey := range pubKeys {
+		data = append(append(data, pubKey...), signs[idx]...)
+	}
+	var pathLen [2]byte
+	binary.BigEndian.PutUint16(pathLen[:], uint16(len(acctPath)))
+	return append(append(data, pathLen[:]...), acctPath...)
+}
+
+func isMultiSigEnvelope(data []byte) bool {
+	return len(data) >= len(multiSigMarker) && bytes.Equal(data[:len(multiSigMarker)], multiSigMarker)
+}
+
+// unpackMultiSig reads a multi-signature envelope, checking every signature against the message returned by signBytes,
+// and returns whatever follows the envelope
+func unpackMultiSig(data []byte, signBytes func(acctPath string, rest []byte) []byte) (*multiSigAuth, []byte, uint32, string) {
+	remain := data[len(multiSigMarker):]
+	if len(remain) < 1 {
+		return nil, nil, ErrorTxTooShort, "Multi-signature envelope too short"
+	}
+	count := int(remain[0])
+	remain = remain[1:]
+	if count == 0 || count > maxMultiSigKeys {
+		return nil, nil, ErrorBadFormat, fmt.Sprintf("Multi-signature envelope must carry between 1 and %d signatures", maxMultiSigKeys)
+	}
+	entryLen := ed25519.PublicKeySize + ed25519.SignatureSize
+	if len(remain) < count*entryLen+2 {
+		return nil, nil, ErrorTxTooShort, "Multi-signature envelope too short"
+	}
+	entries := remain[:count*entryLen]
+	remain = remain[count*entryLen:]
+	pathLen := int(binary.BigEndian.Uint16(remain[:2]))
+	remain = remain[2:]
+	if len(remain) < pathLen {
+		return nil, nil, ErrorTxTooShort, "Multi-signature envelope too short"
+	}
+	auth := &multiSigAuth{acctPath: string(remain[:pathLen])}
+	remain = remain[pathLen:]
+
+	msg := signBytes(auth.acctPath, remain)
+	for idx := 0; idx < count; idx++ {
+		entry := entries[idx*entryLen : (idx+1)*entryLen]
+		pubKey := ed25519.PublicKey(entry[:ed25519.PublicKeySize])
+		for _, signer := range auth.signers {
+			if bytes.Equal(signer, pubKey) {
+				return nil, nil, ErrorBadFormat, "Multi-signature envelope carries a key more than once"
+			}
+		}
+		if !ed25519.Verify(pubKey, msg, entry[ed25519.PublicKeySize:]) {
+			return nil, nil, ErrorTxBadSign, "Transaction signature invalid"
+		}
+		auth.signers = append(auth.signers, pubKey)
+	}
+	return auth, remain, ErrorOk, ""
+}
+
+// multiSigAccount returns the multi-signature account at acctPath (nil if there is no such account)
+func multiSigAccount(txn KVTxn, acctPath string) (*loginEntry, string, error) {
+	login, parentPath := domainUserTypes.MatchFromPath(acctPath)
+	if login == nil {
+		return nil, "", nil
+	}
+	existing, err := getBadgerRaw(txn, acctPath+"/auth")
+	if err != nil || existing == nil {
+		return nil, "", err
+	}
+	err = login.queryAccountData(txn, acctPath, acctPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !login.isMultiSig() {
+		return nil, "", nil
+	}
+	return login, parentPath, nil
+}
+
+// lookupMultiSig returns the account named by a multi-signature envelope, provided enough of its keys signed
+func (app *AthenaStoreApplication) lookupMultiSig(txn KVTxn, auth *multiSigAuth) (*loginEntry, error) {
+	login, parentPath, err := multiSigAccount(txn, auth.acctPath)
+	if err != nil {
+		return nil, err
+	}
+	if login == nil {
+		return nil, errUnknownAccount
+	}
+	var signed int64
+	for _, pubKey := range login.PubKeys {
+		for _, signer := range auth.signers {
+			if bytes.Equal(pubKey, signer) {
+				signed++
+				break
+			}
+		}
+	}
+	if signed < login.Threshold {
+		return nil, errNotEnoughSigners
+	}
+	if parentPath != "" {
+		err = app.verifyParentSign(txn, login, parentPath, auth.acctPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return login, nil
+}
@@ -0,0 +1,99 @@
+package app
+
+// Remembers the nonce reached by a key once no account holds it any longer (the account was deleted, expired, or
+// moved to another key), so the transactions it signed cannot be replayed should the key be used again.  The
+// tombstone lives under mesh/nonce/ and is carried into the next account record to take up the key.  A
+// multi-signature account signs by its path rather than a key, so its tombstone is kept under mesh/nonce/<path>
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+)
+
+const nonceTombstonePrefix = "mesh/nonce/"
+
+func nonceTombstoneKey(pubKey []byte) string {
+	return nonceTombstonePrefix + base64.RawURLEncoding.EncodeToString(pubKey)
+}
+
+func multiSigTombstoneKey(acctPath string) string {
+	return nonceTombstonePrefix + acctPath
+}
+
+func readNonceTombstone(txn KVTxn, tombstoneKey string) (int64, error) {
+	value, err := GetBadgerVal(txn, tombstoneKey)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	nonce, _ := NumberToInt64(value)
+	return nonce, nil
+}
+
+// expectedNonce returns the nonce expected on the next transaction signed by pubKey (belonging to user, if any)
+func expectedNonce(txn KVTxn, user *loginEntry, pubKey ed25519.PublicKey) (int64, error) {
+	if user != nil {
+		return user.nextNonce(), nil
+	}
+	return readNonceTombstone(txn, nonceTombstoneKey(pubKey))
+}
+
+// accountTombstoneKeyAndNonce returns where the tombstone of the account record at authPath would be kept (empty if
+// it holds no keys) and the nonce it has reached
+func accountTombstoneKeyAndNonce(authPath string, value interface{}) (string, int64) {
+	acctData, ok := value.(map[string]interface{})
+	if !ok {
+		return "", 0
+	}
+	nonce, _ := NumberToInt64(acctData["nonce"])
+	if pubKey, _ := acctData["pubKey"].([]byte); len(pubKey) > 0 {
+		return nonceTombstoneKey(pubKey), nonce
+	}
+	if pubKeys, _ := acctData["pubKeys"].([]interface{}); len(pubKeys) > 0 {
+		return multiSigTombstoneKey(strings.TrimSuffix(authPath, "/auth")), nonce
+	}
+	return "", nonce
+}
+
+// handleNonceChange maintains the tombstones as the key of an account record changes.  If the new key has a
+// tombstone then value has its nonce raised to match
+func (app *AthenaStoreApplication) handleNonceChange(txn KVTxn, authPath string, value interface{}) error {
+	var oldKey string
+	var oldNonce int64
+	gOldAcctData, err := GetBadgerVal(txn, authPath)
+	if err == nil && gOldAcctData != nil {
+		oldKey, oldNonce = accountTombstoneKeyAndNonce(authPath, gOldAcctData)
+	}
+	newKey, newNonce := accountTombstoneKeyAndNonce(authPath, value)
+	if oldKey == newKey {
+		return nil
+	}
+
+	if oldKey != "" {
+		tombstone, err := readNonceTombstone(txn, oldKey)
+		if err != nil {
+			return err
+		}
+		if oldNonce > tombstone {
+			encNonce, err := ToBadgerType(oldNonce)
+			if err != nil {
+				return err
+			}
+			err = app.storeRaw(txn, oldKey, encNonce)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if newKey != "" {
+		tombstone, err := readNonceTombstone(txn, newKey)
+		if err != nil || tombstone == 0 {
+			return err
+		}
+		if tombstone > newNonce {
+			value.(map[string]interface{})["nonce"] = tombstone
+		}
+		return app.storeRaw(txn, newKey, nil)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package app
+
+// Maintains the permission table, which is stored on the chain at config/permissions so that it can be changed by
+// root without recompiling every node.  Each entry of the table is a map:
+//   path       - regex identifying the keys this entry applies to
+//   userType   - type of account this entry grants access to (root, user, login, group, domain; absent for anonymous access)
+//   write      - true if this grants write access (otherwise read access)
+//   ownerMatch - true if the first grouping of path must match the path of the user attempting access
+//   groupRole  - role (member, admin, owner) the user must hold in the group named by the first grouping of path
+//   auth       - true if path identifies account records
+// The table in effect is cached, and is only reloaded once a block changing it has been committed so that every node
+// switches to the new table at the same height.  A chain keeps the table it started with (see defaultPermissions) until
+// root changes it, so the rules a newer build brings are added to a running chain by a root transaction: DoPermissions
+// sends one adding whichever of them the chain is missing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	cfg "github.com/tendermint/tendermint/config"
+	tmlog "github.com/tendermint/tendermint/libs/log"
+	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
+)
+
+const permissionsKey = "config/permissions"
+
+type permissionRule struct {
+	PathPat    *regexp.Regexp
+	UserType   *userTypeConfig // nil if this applies to anonymous access
+	CanWrite   bool
+	OwnerMatch bool
+	GroupRole  int // role required in the group matched by the first grouping (groupRoleNone if not a group rule)
+	IsAuth     bool
+}
+
+// defaultPermissionRules returns the permission table used by chains that have not stored one of their own
+func defaultPermissionRules() []permissionRule {
+	rules := make([]permissionRule, 0, len(defaultPermissions))
+	for _, perm := range defaultPermissions {
+		permPath := permPaths[perm.PathPat]
+		rules = append(rules, permissionRule{
+			PathPat:    permPath.PathPat,
+			UserType:   perm.UserType,
+			CanWrite:   perm.CanWrite,
+			OwnerMatch: permPath.PathPat.NumSubexp() > 0 && perm.GroupRole == groupRoleNone,
+			GroupRole:  perm.GroupRole,
+			IsAuth:     permPath.IsAuth,
+		})
+	}
+	return rules
+}
+
+func userTypeByName(name string) *userTypeConfig {
+	for _, typ := range domainUserTypes.userTypes {
+		if typ.TypeName == name {
+			return typ
+		}
+	}
+	return nil
+}
+
+func encodePermissionRules(rules []permissionRule) []interface{} {
+	result := make([]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		entry := map[string]interface{}{
+			"path":       rule.PathPat.String(),
+			"write":      rule.CanWrite,
+			"ownerMatch": rule.OwnerMatch,
+			"auth":       rule.IsAuth,
+		}
+		if rule.UserType != nil {
+			entry["userType"] = rule.UserType.TypeName
+		}
+		if rule.GroupRole != groupRoleNone {
+			entry["groupRole"] = groupRoleNames[rule.GroupRole]
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func parsePermissionRules(value interface{}) ([]permissionRule, error) {
+	entries, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("Permission table must be a list")
+	}
+	rules := make([]permissionRule, 0, len(entries))
+	for idx, gEntry := range entries {
+		entry, ok := gEntry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Permission %d must be a map", idx)
+		}
+		rule := permissionRule{}
+		for key, val := range entry {
+			var ok bool
+			switch key {
+			case "path":
+				var path string
+				if path, ok = val.(string); ok {
+					var err error
+					if rule.PathPat, err = regexp.Compile(path); err != nil {
+						return nil, fmt.Errorf("Permission %d has an invalid path: %s", idx, err.Error())
+					}
+				}
+			case "userType":
+				var typeName string
+				if typeName, ok = val.(string); ok {
+					rule.UserType = userTypeByName(typeName)
+					ok = rule.UserType != nil
+				}
+			case "write":
+				rule.CanWrite, ok = val.(bool)
+			case "ownerMatch":
+				rule.OwnerMatch, ok = val.(bool)
+			case "groupRole":
+				var roleName string
+				if roleName, ok = val.(string); ok {
+					rule.GroupRole = groupRoleByName(roleName)
+					ok = rule.GroupRole != groupRoleNone
+				}
+			case "auth":
+				rule.IsAuth, ok = val.(bool)
+			default:
+				return nil, fmt.Errorf("Permission %d has unrecognized field %s", idx, key)
+			}
+			if !ok {
+				return nil, fmt.Errorf("Permission %d has unexpected %s %v", idx, key, val)
+			}
+		}
+		if rule.PathPat == nil {
+			return nil, fmt.Errorf("Permission %d is missing a path", idx)
+		}
+		if rule.OwnerMatch && rule.PathPat.NumSubexp() == 0 {
+			return nil, fmt.Errorf("Permission %d is owner-matched but its path has no grouping", idx)
+		}
+		if rule.GroupRole != groupRoleNone && (rule.OwnerMatch || rule.PathPat.NumSubexp() == 0) {
+			return nil, fmt.Errorf("Permission %d requires a group role but its path has no grouping or is also owner-matched", idx)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// readPermissionRules returns the permission table stored in the specified transaction
+func readPermissionRules(txn KVTxn) ([]permissionRule, error) {
+	value, err := GetBadgerVal(txn, permissionsKey)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return defaultPermissionRules(), nil
+	}
+	return parsePermissionRules(value)
+}
+
+// loadPermissions refreshes our cached permission table from the most recently committed state
+func (app *AthenaStoreApplication) loadPermissions() error {
+	txn := app.db.NewTransactionAt(heightVersion(app.treeState.lastBlockHeight), false)
+	defer txn.Discard()
+	rules, err := readPermissionRules(txn)
+	if err != nil {
+		return err
+	}
+	app.permissions = rules
+	return nil
+}
+
+// missingPermissionRules returns the entries of the default table that are not in the stored one (both as encoded by
+// encodePermissionRules), in the order they appear in the default table
+func missingPermissionRules(stored []interface{}) []interface{} {
+	var missing []interface{}
+	for _, rule := range encodePermissionRules(defaultPermissionRules()) {
+		found := false
+		for _, entry := range stored {
+			if reflect.DeepEqual(rule, entry) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, rule)
+		}
+	}
+	return missing
+}
+
+// PermissionsOptions controls what DoPermissions does
+type PermissionsOptions struct {
+	RootKeyFile string // file holding the root user's key
+	RPCAddr     string // RPC address of a node of the chain (default the one in config.toml)
+	Check       bool   // only report the rules that the chain is missing
+}
+
+// rootQuery queries a node for path, signed by the root user
+func rootQuery(client *rpchttp.HTTP, rootKey ed25519.PrivateKey, path string) (interface{}, error) {
+	data := append(append([]byte{}, rootKey.Public().(ed25519.PublicKey)...), ed25519.Sign(rootKey, []byte(path))...)
+	result, err := client.ABCIQuery(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if result.Response.Code != 0 {
+		return nil, fmt.Errorf("query for %s failed: %s", path, result.Response.Info)
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(result.Response.Value))
+	decoder.UseNumber()
+	if err = decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// DoPermissions adds the rules of the default permission table that a running chain is missing to its stored table,
+// with a transaction signed by the root user (or with opts.Check only reports them)
+func DoPermissions(config *cfg.Config, opts PermissionsOptions, logger tmlog.Logger) error {
+	rootKey, err := loadRootPrivKey(opts.RootKeyFile)
+	if err != nil {
+		return err
+	}
+	rpcAddr := opts.RPCAddr
+	if rpcAddr == "" {
+		rpcAddr = strings.Replace(config.RPC.ListenAddress, "tcp://", "http://", 1)
+	}
+	client, err := rpchttp.New(rpcAddr, "/websocket")
+	if err != nil {
+		return err
+	}
+	status, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	gStored, err := rootQuery(client, rootKey, permissionsKey)
+	if err != nil {
+		return err
+	}
+	stored, ok := gStored.([]interface{})
+	if !ok {
+		return fmt.Errorf("%s holds no permission table", permissionsKey)
+	}
+	missing := missingPermissionRules(stored)
+	if len(missing) == 0 {
+		logger.Info("the chain already has every rule of the default permission table")
+		return nil
+	}
+	for _, rule := range missing {
+		encRule, _ := json.Marshal(rule)
+		logger.Info("missing permission rule " + string(encRule))
+	}
+	if opts.Check {
+		logger.Info(fmt.Sprintf("%d rule(s) would be added to %s, nothing was changed", len(missing), permissionsKey))
+		return nil
+	}
+
+	gRoot, err := rootQuery(client, rootKey, "config/rootUser/auth")
+	if err != nil {
+		return err
+	}
+	var nonce int64
+	if root, ok := gRoot.(map[string]interface{}); ok {
+		if numNonce, ok := root["nonce"].(json.Number); ok {
+			if nonce, err = numNonce.Int64(); err != nil {
+				return err
+			}
+		}
+	}
+	body, err := json.Marshal([][]interface{}{{permissionsKey, append(stored, missing...)}})
+	if err != nil {
+		return err
+	}
+	nonceAndBody := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint64(nonceAndBody, uint64(nonce))
+	nonceAndBody = append(nonceAndBody, body...)
+	tx := append([]byte{}, rootKey.Public().(ed25519.PublicKey)...)
+	tx = append(tx, ed25519.Sign(rootKey, TxSignBytes(status.NodeInfo.Network, nonceAndBody))...)
+	tx = append(tx, nonceAndBody...)
+
+	result, err := client.BroadcastTxCommit(tx)
+	if err != nil {
+		return err
+	}
+	if result.CheckTx.Code != 0 {
+		return errors.New(result.CheckTx.Info)
+	}
+	if result.DeliverTx.Code != 0 {
+		return errors.New(result.DeliverTx.Info)
+	}
+	logger.Info(fmt.Sprintf("%d rule(s) added to %s at height %d", len(missing), permissionsKey, result.Height))
+	return nil
+}
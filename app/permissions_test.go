@@ -0,0 +1,44 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestMissingPermissionRules expects a table stored before grants and groups existed, as read back from a query, to be
+// missing exactly their rules
+func TestMissingPermissionRules(t *testing.T) {
+	var older, added []interface{}
+	for _, rule := range encodePermissionRules(defaultPermissionRules()) {
+		path := rule.(map[string]interface{})["path"].(string)
+		if strings.Contains(path, "grant/") || strings.Contains(path, "group") {
+			added = append(added, rule)
+		} else {
+			older = append(older, rule)
+		}
+	}
+	encOlder, err := json.Marshal(older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []interface{}
+	if err = json.Unmarshal(encOlder, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := missingPermissionRules(stored)
+	if len(missing) != len(added) {
+		t.Fatalf("expected %d missing rules, found %d", len(added), len(missing))
+	}
+	for idx, rule := range missing {
+		encRule, _ := json.Marshal(rule)
+		encAdded, _ := json.Marshal(added[idx])
+		if string(encRule) != string(encAdded) {
+			t.Errorf("missing rule %d is %s, expected %s", idx, encRule, encAdded)
+		}
+	}
+	if len(missingPermissionRules(append(stored, missing...))) != 0 {
+		t.Error("expected nothing to be missing once the rules were added")
+	}
+}
@@ -0,0 +1,556 @@
+package app
+
+// Takes snapshots of the application state every few blocks so that a new node can fetch one from its peers rather
+// than replaying every block since genesis.  The calls that serve and restore them follow the state-sync ABCI calls
+// (ListSnapshots, LoadSnapshotChunk, OfferSnapshot and ApplySnapshotChunk) of later versions of Tendermint, which
+// ours lacks, so that they can be wired up as they are once we upgrade.
+//
+// A snapshot holds every key in the store as of a block, less the merkle tree and the block state (which a restore
+// rebuilds) and the schema version, in byte order.  It is split into chunks of whole records:
+//   keyLen   - length of the key (uvarint)
+//   key
+//   valueLen - length of the value (uvarint)
+//   value    - the value in its stored encoding
+// The metadata of a snapshot is a map (in our stored encoding) of:
+//   chainId     - chain the snapshot was taken from
+//   appHash     - application hash as of the block
+//   chunkHashes - sha256 of each chunk, in order
+// and its hash is the sha256 of the chunk hashes.  Each snapshot is kept in a directory (named for its height) beside
+// store.db, holding a file for each chunk and a "snapshot" file describing it
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	snapshotFormat    uint32 = 1       // version of the chunk encoding described above
+	snapshotChunkSize        = 4 << 20 // a chunk is cut at the first record boundary past this many bytes
+	restoreBatchSize         = 1000    // number of keys written by each transaction when restoring a store
+)
+
+// Snapshot describes a snapshot of the application state, as the Snapshot message of the state-sync ABCI calls
+type Snapshot struct {
+	Height   uint64 // block height the snapshot was taken at
+	Format   uint32 // encoding of the chunks
+	Chunks   uint32 // number of chunks
+	Hash     []byte // sha256 of the chunk hashes
+	Metadata []byte // chain, app hash and chunk hashes of the snapshot
+}
+
+// OfferSnapshotResult is our answer to OfferSnapshot, numbered as ResponseOfferSnapshot_Result
+type OfferSnapshotResult int32
+
+const (
+	// OfferSnapshotUnknown no answer
+	OfferSnapshotUnknown OfferSnapshotResult = iota
+	// OfferSnapshotAccept the snapshot will be restored, send its chunks
+	OfferSnapshotAccept
+	// OfferSnapshotAbort no snapshot can be restored
+	OfferSnapshotAbort
+	// OfferSnapshotReject this snapshot cannot be restored, offer another
+	OfferSnapshotReject
+	// OfferSnapshotRejectFormat no snapshot of this format can be restored
+	OfferSnapshotRejectFormat
+	// OfferSnapshotRejectSender no snapshot from this sender should be offered
+	OfferSnapshotRejectSender
+)
+
+// ApplySnapshotChunkResult is our answer to ApplySnapshotChunk, numbered as ResponseApplySnapshotChunk_Result
+type ApplySnapshotChunkResult int32
+
+const (
+	// ApplySnapshotChunkUnknown no answer
+	ApplySnapshotChunkUnknown ApplySnapshotChunkResult = iota
+	// ApplySnapshotChunkAccept the chunk was restored
+	ApplySnapshotChunkAccept
+	// ApplySnapshotChunkAbort no snapshot can be restored
+	ApplySnapshotChunkAbort
+	// ApplySnapshotChunkRetry the chunk (and any others listed) must be fetched again
+	ApplySnapshotChunkRetry
+	// ApplySnapshotChunkRetrySnapshot the snapshot must be restored again from its first chunk
+	ApplySnapshotChunkRetrySnapshot
+	// ApplySnapshotChunkRejectSnapshot this snapshot cannot be restored, offer another
+	ApplySnapshotChunkRejectSnapshot
+)
+
+type snapshotMetadata struct {
+	chainID     string
+	appHash     []byte
+	chunkHashes [][]byte
+}
+
+type snapshotStore struct {
+	dir        string
+	keepRecent int64          // number of snapshots to keep (0 = keep all)
+	mtx        sync.Mutex     // held while checking or changing taking
+	taking     int64          // height of the snapshot being taken (0 if none)
+	running    sync.WaitGroup // the snapshot being taken, if any
+}
+
+// snapshotRestore tracks a snapshot accepted by OfferSnapshot while its chunks are applied
+type snapshotRestore struct {
+	snapshot  *Snapshot
+	meta      *snapshotMetadata
+	nextChunk uint32
+}
+
+func (meta *snapshotMetadata) encode() ([]byte, error) {
+	chunkHashes := make([]interface{}, 0, len(meta.chunkHashes))
+	for _, hash := range meta.chunkHashes {
+		chunkHashes = append(chunkHashes, hash)
+	}
+	return ToBadgerType(map[string]interface{}{
+		"chainId":     meta.chainID,
+		"appHash":     meta.appHash,
+		"chunkHashes": chunkHashes,
+	})
+}
+
+func decodeSnapshotMetadata(data []byte) (*snapshotMetadata, error) {
+	val, err := fromBadgerType(data)
+	if err != nil {
+		return nil, err
+	}
+	mapVal, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("snapshot metadata is not a map")
+	}
+	meta := &snapshotMetadata{}
+	if meta.chainID, ok = mapVal["chainId"].(string); !ok {
+		return nil, errors.New("snapshot metadata has no chainId")
+	}
+	if meta.appHash, ok = mapVal["appHash"].([]byte); !ok {
+		return nil, errors.New("snapshot metadata has no appHash")
+	}
+	chunkHashes, ok := mapVal["chunkHashes"].([]interface{})
+	if !ok {
+		return nil, errors.New("snapshot metadata has no chunkHashes")
+	}
+	for _, gHash := range chunkHashes {
+		hash, ok := gHash.([]byte)
+		if !ok || len(hash) != sha256.Size {
+			return nil, errors.New("snapshot metadata has an unexpected chunk hash")
+		}
+		meta.chunkHashes = append(meta.chunkHashes, hash)
+	}
+	return meta, nil
+}
+
+func snapshotHash(chunkHashes [][]byte) []byte {
+	hash := sha256.Sum256(bytes.Join(chunkHashes, nil))
+	return hash[:]
+}
+
+func appendSnapshotRecord(chunk []byte, key []byte, value []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	chunk = append(chunk, lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(key)))]...)
+	chunk = append(chunk, key...)
+	chunk = append(chunk, lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(value)))]...)
+	return append(chunk, value...)
+}
+
+func readSnapshotRecords(chunk []byte) ([]string, [][]byte, error) {
+	var keys []string
+	var values [][]byte
+	remain := chunk
+	readField := func() ([]byte, error) {
+		fieldLen, lenSize := binary.Uvarint(remain)
+		if lenSize <= 0 || uint64(len(remain)-lenSize) < fieldLen {
+			return nil, errors.New("snapshot chunk has a truncated record")
+		}
+		field := remain[lenSize : uint64(lenSize)+fieldLen]
+		remain = remain[uint64(lenSize)+fieldLen:]
+		return field, nil
+	}
+	for len(remain) > 0 {
+		key, err := readField()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := readField()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, string(key))
+		values = append(values, value)
+	}
+	return keys, values, nil
+}
+
+func newSnapshotStore(dir string, keepRecent int64) *snapshotStore {
+	return &snapshotStore{dir: dir, keepRecent: keepRecent}
+}
+
+func (store *snapshotStore) heightDir(height uint64) string {
+	return filepath.Join(store.dir, strconv.FormatUint(height, 10))
+}
+
+// begin notes that a snapshot of the specified height is being taken, returning false if one already is
+func (store *snapshotStore) begin(height int64) bool {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.taking != 0 {
+		return false
+	}
+	store.taking = height
+	store.running.Add(1)
+	return true
+}
+
+func (store *snapshotStore) end() {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	store.taking = 0
+	store.running.Done()
+}
+
+// pinnedHeight returns the height of the snapshot being taken, whose block must not be discarded (0 if none)
+func (store *snapshotStore) pinnedHeight() int64 {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	return store.taking
+}
+
+// wait returns once any snapshot being taken is finished
+func (store *snapshotStore) wait() {
+	store.running.Wait()
+}
+
+// list returns every snapshot we hold, newest first
+func (store *snapshotStore) list() ([]*Snapshot, error) {
+	entries, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		height, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() {
+			continue // such as a snapshot still being written
+		}
+		snapshot, err := store.get(height)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Height > snapshots[j].Height })
+	return snapshots, nil
+}
+
+// get returns the snapshot taken at the specified height
+func (store *snapshotStore) get(height uint64) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(store.heightDir(height), "snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	val, err := fromBadgerType(data)
+	if err != nil {
+		return nil, err
+	}
+	mapVal, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("snapshot of block %d is not a map", height)
+	}
+	snapshot := &Snapshot{Height: height}
+	format, ok := NumberToUint64(mapVal["format"])
+	if !ok {
+		return nil, fmt.Errorf("snapshot of block %d has no format", height)
+	}
+	chunks, ok := NumberToUint64(mapVal["chunks"])
+	if !ok {
+		return nil, fmt.Errorf("snapshot of block %d has no chunk count", height)
+	}
+	snapshot.Format = uint32(format)
+	snapshot.Chunks = uint32(chunks)
+	if snapshot.Hash, ok = mapVal["hash"].([]byte); !ok {
+		return nil, fmt.Errorf("snapshot of block %d has no hash", height)
+	}
+	if snapshot.Metadata, ok = mapVal["metadata"].([]byte); !ok {
+		return nil, fmt.Errorf("snapshot of block %d has no metadata", height)
+	}
+	return snapshot, nil
+}
+
+// loadChunk returns a chunk of the snapshot taken at the specified height
+func (store *snapshotStore) loadChunk(height uint64, chunk uint32) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(store.heightDir(height), strconv.FormatUint(uint64(chunk), 10)))
+}
+
+// create takes a snapshot of the store as of the specified height, then removes any snapshots beyond keepRecent
+func (store *snapshotStore) create(db KVStore, height int64) error {
+	finalDir := store.heightDir(uint64(height))
+	tmpDir := finalDir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+
+	txn := db.NewTransactionAt(heightVersion(height), false)
+	defer txn.Discard()
+	state, err := readBlockState(txn)
+	if err != nil {
+		return err
+	}
+	if state.lastBlockHeight != height {
+		return fmt.Errorf("block %d is not retained in the store", height)
+	}
+	meta := &snapshotMetadata{chainID: state.chainID, appHash: state.lastBlockHash}
+
+	var chunk []byte
+	writeChunk := func() error {
+		hash := sha256.Sum256(chunk)
+		chunkFile := filepath.Join(tmpDir, strconv.Itoa(len(meta.chunkHashes)))
+		meta.chunkHashes = append(meta.chunkHashes, hash[:])
+		err := ioutil.WriteFile(chunkFile, chunk, 0600)
+		chunk = chunk[:0]
+		return err
+	}
+	iter := txn.NewIterator(KVIteratorOptions{})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if !isDumpedKey(string(iter.Key())) {
+			continue
+		}
+		value, err := iter.Value()
+		if err == nil {
+			chunk = appendSnapshotRecord(chunk, iter.Key(), value)
+			if len(chunk) >= snapshotChunkSize {
+				err = writeChunk()
+			}
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	iter.Close()
+	if len(chunk) > 0 || len(meta.chunkHashes) == 0 {
+		if err = writeChunk(); err != nil {
+			return err
+		}
+	}
+
+	metadata, err := meta.encode()
+	if err != nil {
+		return err
+	}
+	encSnapshot, err := ToBadgerType(map[string]interface{}{
+		"format":   snapshotFormat,
+		"chunks":   len(meta.chunkHashes),
+		"hash":     snapshotHash(meta.chunkHashes),
+		"metadata": metadata,
+	})
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "snapshot"), encSnapshot, 0600); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(finalDir); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpDir, finalDir); err != nil {
+		return err
+	}
+	return store.prune()
+}
+
+// prune removes the oldest snapshots beyond keepRecent
+func (store *snapshotStore) prune() error {
+	if store.keepRecent <= 0 {
+		return nil
+	}
+	snapshots, err := store.list()
+	if err != nil {
+		return err
+	}
+	for idx := int(store.keepRecent); idx < len(snapshots); idx++ {
+		if err = os.RemoveAll(store.heightDir(snapshots[idx].Height)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeSnapshot starts taking a snapshot of the block just committed, if one is due
+func (app *AthenaStoreApplication) takeSnapshot() {
+	height := app.treeState.lastBlockHeight
+	if app.snapshots == nil || app.config.SnapshotInterval <= 0 || height%app.config.SnapshotInterval != 0 {
+		return
+	}
+	if !app.snapshots.begin(height) {
+		app.logger.Error(fmt.Sprintf("Skipping the snapshot of block %d, the previous snapshot is still being taken", height))
+		return
+	}
+	go func() {
+		defer app.snapshots.end()
+		if err := app.snapshots.create(app.db, height); err != nil {
+			app.logger.Error(fmt.Sprintf("Unexpected taking the snapshot of block %d: %s", height, err.Error()))
+			return
+		}
+		app.logger.Info(fmt.Sprintf("took a snapshot of block %d", height))
+	}()
+}
+
+// restoreBatch writes a batch of keys (in their stored encoding) into a store being restored as of the specified
+// height, folding them into the merkle tree.  Symlinks, the indexes under mesh/ and nonce tombstones are restored
+// along with everything else, so keys are stored as they are rather than through setKey
+func (app *AthenaStoreApplication) restoreBatch(height int64, keys []string, values [][]byte) error {
+	version := heightVersion(height)
+	txn := app.db.NewTransactionAt(version, true)
+	defer txn.Discard()
+	for idx, key := range keys {
+		if !isDumpedKey(key) {
+			return fmt.Errorf("cannot restore %s", key)
+		}
+		if err := app.storeRaw(txn, key, values[idx]); err != nil {
+			return err
+		}
+	}
+	if err := app.updateAppHash(txn); err != nil {
+		return err
+	}
+	return txn.CommitAt(version)
+}
+
+// finishRestore checks the state restored into an empty store against the app hash it should have, then records
+// the block it is as of and starts working from it
+func (app *AthenaStoreApplication) finishRestore(chainID string, height int64, appHash []byte) error {
+	if !bytes.Equal(app.treeState.lastBlockHash, appHash) {
+		return fmt.Errorf("restored state has app hash %X rather than %X", app.treeState.lastBlockHash, appHash)
+	}
+	version := heightVersion(height)
+	app.treeState.chainID = chainID
+	app.treeState.nextBlockHeight = height
+	txn := app.db.NewTransactionAt(version, true)
+	defer txn.Discard()
+	err := app.updateBlockState(txn)
+	if err == nil {
+		err = txn.CommitAt(version)
+	}
+	if err != nil {
+		return err
+	}
+	app.treeState.lastBlockHeight = height
+	app.treeState.nextBlockHeight = 0
+
+	err = app.loadPermissions()
+	if err == nil {
+		err = app.loadSymlinks()
+	}
+	if err != nil {
+		return err
+	}
+	app.checkState.mtx.Lock()
+	app.resetCheckState()
+	app.checkState.mtx.Unlock()
+	return nil
+}
+
+// ListSnapshots returns the snapshots we can offer to our peers, as the ListSnapshots ABCI call
+func (app *AthenaStoreApplication) ListSnapshots() []*Snapshot {
+	if app.snapshots == nil {
+		return nil
+	}
+	snapshots, err := app.snapshots.list()
+	if err != nil {
+		app.logger.Error("Unexpected listing snapshots: " + err.Error())
+		return nil
+	}
+	return snapshots
+}
+
+// LoadSnapshotChunk returns a chunk of one of our snapshots, as the LoadSnapshotChunk ABCI call (nil if we do not
+// hold it)
+func (app *AthenaStoreApplication) LoadSnapshotChunk(height uint64, format uint32, chunk uint32) []byte {
+	if app.snapshots == nil || format != snapshotFormat {
+		return nil
+	}
+	data, err := app.snapshots.loadChunk(height, chunk)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			app.logger.Error(fmt.Sprintf("Unexpected loading chunk %d of the snapshot of block %d: %s", chunk, height, err.Error()))
+		}
+		return nil
+	}
+	return data
+}
+
+// OfferSnapshot begins restoring a snapshot into our (empty) store, as the OfferSnapshot ABCI call.  appHash is the
+// app hash of the snapshot's block as verified by the light client
+func (app *AthenaStoreApplication) OfferSnapshot(snapshot *Snapshot, appHash []byte) OfferSnapshotResult {
+	if snapshot == nil {
+		return OfferSnapshotReject
+	}
+	if len(app.treeState.lastBlockHash) != 0 {
+		app.logger.Error("Unexpected: offered a snapshot when the store already holds chain state")
+		return OfferSnapshotAbort
+	}
+	if snapshot.Format != snapshotFormat {
+		return OfferSnapshotRejectFormat
+	}
+	meta, err := decodeSnapshotMetadata(snapshot.Metadata)
+	if err != nil || snapshot.Chunks == 0 || uint32(len(meta.chunkHashes)) != snapshot.Chunks ||
+		!bytes.Equal(snapshotHash(meta.chunkHashes), snapshot.Hash) || !bytes.Equal(meta.appHash, appHash) {
+		return OfferSnapshotReject
+	}
+	app.restore = &snapshotRestore{snapshot: snapshot, meta: meta}
+	app.logger.Info(fmt.Sprintf("restoring the snapshot of block %d (%d chunks)", snapshot.Height, snapshot.Chunks))
+	return OfferSnapshotAccept
+}
+
+// ApplySnapshotChunk restores the next chunk of the snapshot accepted by OfferSnapshot, as the ApplySnapshotChunk
+// ABCI call, along with any chunks that must be fetched again.  Chunks must arrive in order
+func (app *AthenaStoreApplication) ApplySnapshotChunk(index uint32, chunk []byte, sender string) (ApplySnapshotChunkResult, []uint32) {
+	restore := app.restore
+	if restore == nil || index != restore.nextChunk {
+		app.logger.Error(fmt.Sprintf("Unexpected: given chunk %d of a snapshot we are not expecting", index))
+		return ApplySnapshotChunkAbort, nil
+	}
+	height := int64(restore.snapshot.Height)
+	hash := sha256.Sum256(chunk)
+	if !bytes.Equal(hash[:], restore.meta.chunkHashes[index]) {
+		app.logger.Error(fmt.Sprintf("chunk %d of the snapshot of block %d from %s does not match its hash", index, height, sender))
+		return ApplySnapshotChunkRetry, []uint32{index}
+	}
+
+	// the chunk matches its hash, so if it cannot be restored then neither can the snapshot.  Whatever has been
+	// written so far cannot be taken out again, so another snapshot would have to start from a new store
+	keys, values, err := readSnapshotRecords(chunk)
+	for start := 0; err == nil && start < len(keys); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = app.restoreBatch(height, keys[start:end], values[start:end])
+	}
+	restore.nextChunk++
+	if err == nil && restore.nextChunk == restore.snapshot.Chunks {
+		app.restore = nil
+		err = app.finishRestore(restore.meta.chainID, height, restore.meta.appHash)
+		if err == nil {
+			app.logger.Info(fmt.Sprintf("restored the snapshot of block %d", height))
+		}
+	}
+	if err != nil {
+		app.restore = nil
+		app.logger.Error(fmt.Sprintf("Unable to restore the snapshot of block %d (store.db must be removed before trying again): %s", height, err.Error()))
+		return ApplySnapshotChunkAbort, nil
+	}
+	return ApplySnapshotChunkAccept, nil
+}
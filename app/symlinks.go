@@ -0,0 +1,333 @@
+package app
+
+// Maintains the attribute-based symlink definitions, which are stored on the chain at config/symlinks so that root can
+// add new indexes (such as users/name/) without recompiling every node.  See app-symlink.go for the format.
+// When a definition is added, the symlinks for data already in the store are created by a backfill job queued under
+// mesh/symlinkBackfill, which examines a fixed number of keys at the end of every block until it has seen them all.
+// Removing a definition leaves the symlinks it created in place
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+const symlinksKey = "config/symlinks"
+
+const symlinkBackfillKey = "mesh/symlinkBackfill"
+
+// symlinkBackfillKeysPerBlock is the number of keys examined by the backfill jobs at the end of each block
+const symlinkBackfillKeysPerBlock = 1000
+
+// symlinkReservedPrefixes are the locations that symlinks cannot be created under
+var symlinkReservedPrefixes = []string{"user/", "group/", "config/", "keyMap/", "mesh/"}
+
+// symlinkBackfillSkipPrefixes hold keys that can never be the source of a symlink, the backfill jobs skip past them
+var symlinkBackfillSkipPrefixes = []string{"keyMap/", "mesh/"}
+
+type symlinkBackfillJob struct {
+	symLinkMapEntry
+	cursor string // next key to be examined
+}
+
+func encodeSymlinkEntry(entry symLinkMapEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"path": entry.PathPat.String(),
+		"attr": entry.SourceAttr,
+		"dest": entry.DestPrefix,
+	}
+}
+
+func encodeSymlinkEntries(entries []symLinkMapEntry) []interface{} {
+	result := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, encodeSymlinkEntry(entry))
+	}
+	return result
+}
+
+func parseSymlinkEntry(idx int, entry map[string]interface{}) (symLinkMapEntry, error) {
+	result := symLinkMapEntry{}
+	for key, val := range entry {
+		strVal, ok := val.(string)
+		if !ok {
+			return result, fmt.Errorf("Symlink %d has unexpected %s %v", idx, key, val)
+		}
+		switch key {
+		case "path":
+			var err error
+			if result.PathPat, err = regexp.Compile(strVal); err != nil {
+				return result, fmt.Errorf("Symlink %d has an invalid path: %s", idx, err.Error())
+			}
+		case "attr":
+			result.SourceAttr = strVal
+		case "dest":
+			result.DestPrefix = strVal
+		case "cursor":
+			// only found in backfill jobs, handled by our caller
+		default:
+			return result, fmt.Errorf("Symlink %d has unrecognized field %s", idx, key)
+		}
+	}
+	if result.PathPat == nil || result.SourceAttr == "" || result.DestPrefix == "" {
+		return result, fmt.Errorf("Symlink %d requires a path, attr, and dest", idx)
+	}
+	if result.PathPat.NumSubexp() == 0 {
+		return result, fmt.Errorf("Symlink %d has no grouping in its path to link to", idx)
+	}
+	if !strings.HasSuffix(result.DestPrefix, "/") {
+		return result, fmt.Errorf("Symlink %d must have a dest ending in /", idx)
+	}
+	for _, prefix := range symlinkReservedPrefixes {
+		if strings.HasPrefix(result.DestPrefix, prefix) {
+			return result, fmt.Errorf("Symlink %d cannot create symlinks under %s", idx, prefix)
+		}
+	}
+	return result, nil
+}
+
+func parseSymlinkEntries(value interface{}) ([]symLinkMapEntry, error) {
+	entries, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("Symlink definitions must be a list")
+	}
+	result := make([]symLinkMapEntry, 0, len(entries))
+	for idx, gEntry := range entries {
+		entry, ok := gEntry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Symlink %d must be a map", idx)
+		}
+		parsed, err := parseSymlinkEntry(idx, entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, parsed)
+	}
+	return result, nil
+}
+
+func sameSymlinkEntry(a symLinkMapEntry, b symLinkMapEntry) bool {
+	return a.PathPat.String() == b.PathPat.String() && a.SourceAttr == b.SourceAttr && a.DestPrefix == b.DestPrefix
+}
+
+// readSymlinkEntries returns the symlink definitions stored in the specified transaction
+func readSymlinkEntries(txn KVTxn) ([]symLinkMapEntry, error) {
+	value, err := GetBadgerVal(txn, symlinksKey)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return defaultSymLinkPaths, nil
+	}
+	return parseSymlinkEntries(value)
+}
+
+// loadSymlinks refreshes our cached symlink definitions from the most recently committed state
+func (app *AthenaStoreApplication) loadSymlinks() error {
+	txn := app.db.NewTransactionAt(heightVersion(app.treeState.lastBlockHeight), false)
+	defer txn.Discard()
+	entries, err := readSymlinkEntries(txn)
+	if err != nil {
+		return err
+	}
+	app.symlinks = entries
+	return nil
+}
+
+func readSymlinkBackfill(txn KVTxn) ([]symlinkBackfillJob, error) {
+	value, err := GetBadgerVal(txn, symlinkBackfillKey)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	entries, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected: symlink backfill jobs are not a list")
+	}
+	jobs := make([]symlinkBackfillJob, 0, len(entries))
+	for idx, gEntry := range entries {
+		entry, ok := gEntry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unexpected: symlink backfill job %d is not a map", idx)
+		}
+		parsed, err := parseSymlinkEntry(idx, entry)
+		if err != nil {
+			return nil, err
+		}
+		cursor, _ := entry["cursor"].(string)
+		jobs = append(jobs, symlinkBackfillJob{symLinkMapEntry: parsed, cursor: cursor})
+	}
+	return jobs, nil
+}
+
+func (app *AthenaStoreApplication) writeSymlinkBackfill(txn KVTxn, jobs []symlinkBackfillJob) error {
+	if len(jobs) == 0 {
+		return app.storeRaw(txn, symlinkBackfillKey, nil)
+	}
+	entries := make([]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		entry := encodeSymlinkEntry(job.symLinkMapEntry)
+		entry["cursor"] = job.cursor
+		entries = append(entries, entry)
+	}
+	encData, err := ToBadgerType(entries)
+	if err != nil {
+		return err
+	}
+	return app.storeRaw(txn, symlinkBackfillKey, encData)
+}
+
+// queueSymlinkBackfill starts a backfill job for every definition in the specified transaction that we are not
+// currently using
+func (app *AthenaStoreApplication) queueSymlinkBackfill(txn KVTxn) error {
+	entries, err := readSymlinkEntries(txn)
+	if err != nil {
+		return err
+	}
+	jobs, err := readSymlinkBackfill(txn)
+	if err != nil {
+		return err
+	}
+	numJobs := len(jobs)
+	for _, entry := range entries {
+		isNew := true
+		for _, oldEntry := range app.symlinks {
+			if sameSymlinkEntry(entry, oldEntry) {
+				isNew = false
+				break
+			}
+		}
+		if isNew {
+			app.logger.Info("queueing symlink backfill for " + entry.PathPat.String())
+			jobs = append(jobs, symlinkBackfillJob{symLinkMapEntry: entry})
+		}
+	}
+	if len(jobs) == numJobs {
+		return nil
+	}
+	return app.writeSymlinkBackfill(txn, jobs)
+}
+
+// runSymlinkBackfill advances the queued backfill jobs, examining at most symlinkBackfillKeysPerBlock keys
+func (app *AthenaStoreApplication) runSymlinkBackfill(txn KVTxn) error {
+	jobs, err := readSymlinkBackfill(txn)
+	if err != nil || len(jobs) == 0 {
+		return err
+	}
+	budget := symlinkBackfillKeysPerBlock
+	for len(jobs) > 0 && budget > 0 {
+		job := &jobs[0]
+
+		// collect what we need to examine before changing anything, we can only have one iterator open at a time
+		var matched []string
+		finished := true
+		iter := txn.NewIterator(KVIteratorOptions{Prefix: []byte(regexLiteralPrefix(job.PathPat)), KeysOnly: true})
+		for iter.Seek([]byte(job.cursor)); iter.Valid(); {
+			key := string(iter.Key())
+			if skipTo := backfillSkipTo(key); skipTo != "" {
+				iter.Seek([]byte(skipTo))
+				continue
+			}
+			if budget == 0 {
+				job.cursor = key
+				finished = false
+				break
+			}
+			budget--
+			if isMerkleKey(key) && job.PathPat.MatchString(key) {
+				matched = append(matched, key)
+			}
+			iter.Next()
+		}
+		iter.Close()
+
+		for _, key := range matched {
+			err = app.backfillSymlink(txn, job.symLinkMapEntry, key)
+			if err != nil {
+				return err
+			}
+		}
+		if !finished {
+			break
+		}
+		app.logger.Info("finished symlink backfill for " + job.PathPat.String())
+		jobs = jobs[1:]
+	}
+	return app.writeSymlinkBackfill(txn, jobs)
+}
+
+// backfillSkipTo returns the key following the skipped prefix that key lies within (empty if it is not skipped)
+func backfillSkipTo(key string) string {
+	for _, prefix := range symlinkBackfillSkipPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+		}
+	}
+	return ""
+}
+
+// regexLiteralPrefix returns the literal text that every key matched by pat must begin with (empty if pat is not
+// anchored to the start of the key)
+func regexLiteralPrefix(pat *regexp.Regexp) string {
+	re, err := syntax.Parse(pat.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	prefix, _ := syntaxLiteralPrefix(&syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[1:]})
+	return prefix
+}
+
+// syntaxLiteralPrefix collects the literal text at the start of re, returning whether all of re was literal
+func syntaxLiteralPrefix(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(re.Rune), true
+	case syntax.OpCapture:
+		return syntaxLiteralPrefix(re.Sub[0])
+	case syntax.OpConcat:
+		prefix := ""
+		for _, sub := range re.Sub {
+			subPrefix, complete := syntaxLiteralPrefix(sub)
+			prefix += subPrefix
+			if !complete {
+				return prefix, false
+			}
+		}
+		return prefix, true
+	}
+	return "", false
+}
+
+// backfillSymlink creates the symlink for an existing key, leaving alone any symlink already present
+func (app *AthenaStoreApplication) backfillSymlink(txn KVTxn, entry symLinkMapEntry, srcPath string) error {
+	gData, err := GetBadgerVal(txn, srcPath)
+	if err != nil {
+		return err
+	}
+	data, ok := gData.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	attrValue, ok := data[entry.SourceAttr].(string)
+	if !ok || attrValue == "" {
+		return nil
+	}
+	destPath := entry.DestPrefix + attrValue
+	existing, err := getBadgerRaw(txn, destPath)
+	if err != nil || existing != nil {
+		return err
+	}
+	encLinkPath, err := ToBadgerType(entry.PathPat.FindStringSubmatch(srcPath)[1])
+	if err != nil {
+		return err
+	}
+	return app.storeRaw(txn, destPath, encLinkPath)
+}
@@ -5,13 +5,17 @@ import (
 	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/odysseus654/athenamesh/app"
+
 	uuid "github.com/satori/go.uuid"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
 	ctypes "github.com/tendermint/tendermint/rpc/core/types"
 )
 
@@ -29,19 +33,26 @@ type transaction struct {
 	body      map[string]interface{} // encoded to JSON
 }
 
-func (serv *webService) broadcast(msg [][]interface{}, key ed25519.PrivateKey, bcastType broadcastType) error {
-	if key == nil || msg != nil {
+func (serv *webService) broadcast(msg [][]interface{}, key ed25519.PrivateKey, nonce int64, bcastType broadcastType) error {
+	if key == nil || msg == nil {
 		return errors.New("nil message or key passed to broadcast")
 	}
 	if len(key) != ed25519.PrivateKeySize {
 		return errors.New("Key with the wrong length passed to broadcast")
 	}
+	chainID, err := serv.chainID()
+	if err != nil {
+		return err
+	}
 	jsonResult, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	sign := ed25519.Sign(key, jsonResult)
-	tx := append(append([]byte(key[ed25519.PublicKeySize:]), sign...), jsonResult...)
+	nonceAndBody := make([]byte, 8, 8+len(jsonResult))
+	binary.BigEndian.PutUint64(nonceAndBody, uint64(nonce))
+	nonceAndBody = append(nonceAndBody, jsonResult...)
+	sign := ed25519.Sign(key, app.TxSignBytes(chainID, nonceAndBody))
+	tx := append(append([]byte(key[ed25519.PublicKeySize:]), sign...), nonceAndBody...)
 
 	var result *ctypes.ResultBroadcastTx
 
@@ -74,6 +85,31 @@ func (serv *webService) broadcast(msg [][]interface{}, key ed25519.PrivateKey, b
 	return nil
 }
 
+// chainID returns the ID of the chain we are connected to, which must be included in any transaction we sign
+func (serv *webService) chainID() (string, error) {
+	if serv.ChainID == "" {
+		status, err := serv.RPC.Status()
+		if err != nil {
+			return "", err
+		}
+		serv.ChainID = status.NodeInfo.Network
+	}
+	return serv.ChainID, nil
+}
+
+// accountNonce returns the nonce to sign the next transaction with, given the account object returned by a query
+func accountNonce(acct map[string]interface{}) (int64, error) {
+	genNonce, ok := acct["nonce"]
+	if !ok {
+		return 0, nil // account has never signed anything
+	}
+	numNonce, ok := genNonce.(json.Number)
+	if !ok {
+		return 0, errors.New("account has non-numeric nonce attribute")
+	}
+	return numNonce.Int64()
+}
+
 func (serv *webService) query(path string, key ed25519.PrivateKey) (interface{}, error) {
 	if path == "" {
 		return nil, errors.New("empty path passed to query")
@@ -87,13 +123,17 @@ func (serv *webService) query(path string, key ed25519.PrivateKey) (interface{},
 		sign = ed25519.Sign(key, []byte(path))
 	}
 
-	result, err := serv.RPC.ABCIQuery(path, sign)
+	prove := serv.Headers != nil
+	result, err := serv.RPC.ABCIQueryWithOptions(path, sign, rpcclient.ABCIQueryOptions{Prove: prove})
 	if err != nil {
 		return nil, err
 	}
 	if result.Response.Code != 0 {
 		return nil, errors.New(result.Response.Info)
 	}
+	if prove {
+		return serv.verifiedQueryValue(result.Response, path)
+	}
 	if result.Response.Value == nil {
 		return nil, nil
 	}
@@ -199,6 +239,11 @@ func (serv *webService) userLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "user query has pubkey with unexpected length", http.StatusInternalServerError)
 		return
 	}
+	nonce, err := accountNonce(saltResult)
+	if err != nil {
+		http.Error(w, "user query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	genSalt, ok := saltResult["salt"]
 	if !ok {
 		http.Error(w, "user query missing salt attribute", http.StatusInternalServerError)
@@ -245,7 +290,7 @@ func (serv *webService) userLogin(w http.ResponseWriter, r *http.Request) {
 		[]interface{}{tokenPath, createTokenKey},
 	}
 
-	err = serv.broadcast(createTokenTx, privKey, bcastSync)
+	err = serv.broadcast(createTokenTx, privKey, nonce, bcastSync)
 	if err != nil {
 		http.Error(w, "broadcast: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -324,7 +369,7 @@ func (serv *webService) userCreate(w http.ResponseWriter, r *http.Request) {
 		[]interface{}{fmt.Sprintf("user/%s/email", username), createEmailKey},
 	}
 
-	err = serv.broadcast(createUserTx, privKey, bcastCommit)
+	err = serv.broadcast(createUserTx, privKey, 0, bcastCommit)
 	if err != nil {
 		http.Error(w, "broadcast: "+err.Error(), http.StatusInternalServerError)
 		return
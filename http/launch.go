@@ -4,18 +4,35 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/odysseus654/athenamesh/common"
 
+	lite "github.com/tendermint/tendermint/lite2"
+	litedb "github.com/tendermint/tendermint/lite2/store/db"
 	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
+	dbm "github.com/tendermint/tm-db"
 )
 
+// LiteConfig describes the light client used to verify query responses.  It starts from a header trusted out of band
+// and checks every later header against witnesses, which must be nodes other than the one answering our queries
+type LiteConfig struct {
+	ChainID     string
+	TrustPeriod time.Duration // how long a verified header may be trusted (somewhat less than the unbonding period)
+	TrustHeight int64         // height of the header trusted out of band
+	TrustHash   []byte        // hash of the header trusted out of band
+	Witnesses   []string      // RPC addresses of the witnesses
+}
+
 type webService struct {
 	RPCPort int
 	Prefix  string
 	RPC     *rpchttp.HTTP
 	Server  *http.Server
 	Mux     *http.ServeMux
+	Headers HeaderSource // if non-nil, queries are proven and checked against headers from this source
+	ChainID string       // retrieved from the node on first use
+	Lite    *LiteConfig  // if non-nil, Headers is set up from a light client when we start
 }
 
 func webStub(w http.ResponseWriter, r *http.Request) {
@@ -54,10 +71,23 @@ func (serv *webService) prepareServer() error {
 // Start launching the web service
 func (serv *webService) Start(ctx context.Context) error {
 	var err error
-	serv.RPC, err = rpchttp.New(fmt.Sprintf("http://127.0.0.1:%d", serv.RPCPort), "/websocket")
+	rpcAddr := fmt.Sprintf("http://127.0.0.1:%d", serv.RPCPort)
+	serv.RPC, err = rpchttp.New(rpcAddr, "/websocket")
 	if err != nil {
 		return err
 	}
+	if serv.Lite != nil {
+		liteClient, err := lite.NewHTTPClient(serv.Lite.ChainID, lite.TrustOptions{
+			Period: serv.Lite.TrustPeriod,
+			Height: serv.Lite.TrustHeight,
+			Hash:   serv.Lite.TrustHash,
+		}, rpcAddr, serv.Lite.Witnesses, litedb.New(dbm.NewMemDB(), serv.Lite.ChainID))
+		if err != nil {
+			return err
+		}
+		serv.Headers = LiteHeaderSource(liteClient)
+		serv.ChainID = serv.Lite.ChainID
+	}
 
 	serv.Server = &http.Server{Addr: ":21478", Handler: serv.Mux}
 	return serv.Server.ListenAndServe()
@@ -79,11 +109,13 @@ func (serv *webService) Stop(ctx context.Context) error {
 	return err
 }
 
-// NewWebService creates and returns a new webservice
-func NewWebService(rpcPort int, prefix string) (common.Service, error) {
+// NewWebService creates and returns a new webservice.  Query responses are verified with a light client if liteConfig
+// is non-nil, otherwise the local node is trusted to answer them truthfully
+func NewWebService(rpcPort int, prefix string, liteConfig *LiteConfig) (common.Service, error) {
 	serv := &webService{
 		RPCPort: rpcPort,
 		Prefix:  prefix,
+		Lite:    liteConfig,
 	}
 	err := serv.prepareServer()
 	return serv, err
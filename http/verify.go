@@ -0,0 +1,150 @@
+package http
+
+// Verifies proven query responses from the mesh against the application hash of a trusted header, so we do not
+// have to trust whichever RPC node answered the query
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/odysseus654/athenamesh/app"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/merkle"
+	lite "github.com/tendermint/tendermint/lite2"
+	"github.com/tendermint/tendermint/types"
+)
+
+// HeaderSource returns a trusted header for the specified height (such as one verified by a light client)
+type HeaderSource func(height int64) (*types.Header, error)
+
+var proofRuntime = newProofRuntime()
+
+func newProofRuntime() *merkle.ProofRuntime {
+	prt := merkle.NewProofRuntime()
+	prt.RegisterOpDecoder(app.ProofOpMerkle, app.MerkleProofOpDecoder)
+	return prt
+}
+
+// verifyQueryResponse checks that a proven query response for path is anchored in the app hash of the given header.
+// The header must be for the block following the height of the response, as that is where its app hash is recorded.
+// A path passing through symlinks carries a proof of each of them first, in the order they were followed; what each
+// symlink points at is given away by the key proven after it
+func verifyQueryResponse(resp abcitypes.ResponseQuery, path string, header *types.Header) error {
+	if resp.Proof == nil || len(resp.Proof.Ops) == 0 {
+		return errors.New("query response carries no proof")
+	}
+	if header == nil || header.Height != resp.Height+1 {
+		return fmt.Errorf("expected the header for height %d to verify this query", resp.Height+1)
+	}
+	ops := resp.Proof.Ops
+	if !bytes.Equal(ops[len(ops)-1].Key, resp.Key) {
+		return fmt.Errorf("query response for %s does not end with a proof of it", resp.Key)
+	}
+
+	remaining := path
+	for idx, pop := range ops {
+		segments := strings.SplitN(remaining, ":", 2)
+		if string(pop.Key) != segments[0] {
+			return fmt.Errorf("query for %s was answered with a proof for %s", segments[0], pop.Key)
+		}
+		var args [][]byte
+		if idx == len(ops)-1 {
+			if resp.Value != nil {
+				if len(segments) > 1 {
+					return fmt.Errorf("query for %s was answered with the symlink %s", path, pop.Key)
+				}
+				args = [][]byte{resp.Value}
+			}
+		} else {
+			if len(segments) < 2 {
+				return fmt.Errorf("query for %s was answered with a proof for %s after resolving it", path, ops[idx+1].Key)
+			}
+			nextSegment := "/" + strings.SplitN(segments[1], ":", 2)[0]
+			if !bytes.HasSuffix(ops[idx+1].Key, []byte(nextSegment)) {
+				return fmt.Errorf("query for %s followed %s to %s", path, pop.Key, ops[idx+1].Key)
+			}
+			dest := strings.TrimSuffix(string(ops[idx+1].Key), nextSegment)
+			encDest, err := app.ToBadgerType(dest)
+			if err != nil {
+				return err
+			}
+			args = [][]byte{encDest}
+			remaining = dest + "/" + segments[1]
+		}
+
+		op, err := proofRuntime.Decode(pop)
+		if err != nil {
+			return err
+		}
+		root, err := op.Run(args)
+		if err != nil {
+			return fmt.Errorf("proof for %s: %s", pop.Key, err.Error())
+		}
+		if len(root) != 1 || !bytes.Equal(root[0], header.AppHash) {
+			return fmt.Errorf("proof for %s does not match the app hash of block %d", pop.Key, header.Height)
+		}
+	}
+	return nil
+}
+
+// LiteHeaderSource returns headers verified by a light client, which must be configured with witnesses independent
+// of the node answering our queries (a header from that node alone proves nothing)
+func LiteHeaderSource(client *lite.Client) HeaderSource {
+	return func(height int64) (*types.Header, error) {
+		signed, err := client.VerifyHeaderAtHeight(height, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return signed.Header, nil
+	}
+}
+
+// verifiedQueryValue verifies a proven query response for path and decodes the value it proved
+func (serv *webService) verifiedQueryValue(resp abcitypes.ResponseQuery, path string) (interface{}, error) {
+	header, err := serv.Headers(resp.Height + 1)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyQueryResponse(resp, path, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Value == nil {
+		return nil, nil
+	}
+	value, err := app.DecodeValue(resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	return jsonFromStored(value), nil
+}
+
+// jsonFromStored converts a decoded value into the form we would have received from an unproven (JSON) query
+func jsonFromStored(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return base64.RawURLEncoding.EncodeToString(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for idx, entry := range v {
+			result[idx] = jsonFromStored(entry)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, entry := range v {
+			result[key] = jsonFromStored(entry)
+		}
+		return result
+	case bool, string, nil:
+		return v
+	default:
+		return json.Number(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/odysseus654/athenamesh/app"
+
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+	tmlog "github.com/tendermint/tendermint/libs/log"
+	"github.com/tendermint/tendermint/types"
+)
+
+func testPubKey(seed byte) string {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// newVerifyTestApp starts a chain holding two users, the first of them reachable through an email symlink, returning
+// the header that would carry its app hash
+func newVerifyTestApp(t *testing.T) (*app.AthenaStoreApplication, *types.Header) {
+	athenaApp := app.NewAthenaStoreApplication(app.NewMemoryStore(), app.AppConfig{}, tmlog.NewNopLogger())
+	appState, err := json.Marshal(app.GenesisState{
+		RootPubKey: testPubKey(1),
+		Accounts: map[string]map[string]interface{}{
+			"user/carol": {"pubKey": testPubKey(2), "salt": "carolsalt"},
+			"user/dave":  {"pubKey": testPubKey(3), "salt": "davesalt"},
+		},
+		Data: map[string]interface{}{
+			"user/carol/email": map[string]interface{}{"hash": "carolhash"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	athenaApp.InitChain(abcitypes.RequestInitChain{ChainId: "athenamesh-test", AppStateBytes: appState})
+	info := athenaApp.Info(abcitypes.RequestInfo{})
+	return athenaApp, &types.Header{Height: info.LastBlockHeight + 1, AppHash: info.LastBlockAppHash}
+}
+
+func provenQuery(t *testing.T, athenaApp *app.AthenaStoreApplication, path string) abcitypes.ResponseQuery {
+	resp := athenaApp.Query(abcitypes.RequestQuery{Path: path, Prove: true})
+	if resp.Code != 0 {
+		t.Fatalf("query for %s failed with code %d: %s", path, resp.Code, resp.Info)
+	}
+	return resp
+}
+
+// TestVerifyQueryResponse expects an anonymous salt lookup through a symlink to verify, and any tampering with the
+// response to be caught
+func TestVerifyQueryResponse(t *testing.T) {
+	athenaApp, header := newVerifyTestApp(t)
+	const path = "users/email/carolhash:auth"
+
+	resp := provenQuery(t, athenaApp, path)
+	if err := verifyQueryResponse(resp, path, header); err != nil {
+		t.Fatalf("expected the response to verify: %s", err.Error())
+	}
+	if len(resp.Proof.Ops) != 2 || string(resp.Key) != "user/carol/auth" {
+		t.Fatalf("expected proofs of the symlink and user/carol/auth, got %d ending with %s", len(resp.Proof.Ops), resp.Key)
+	}
+
+	tampered := provenQuery(t, athenaApp, path)
+	tampered.Value = bytes.Replace(tampered.Value, []byte("carolsalt"), []byte("mallysalt"), 1)
+	if bytes.Equal(tampered.Value, resp.Value) {
+		t.Fatal("expected the salt to appear in the stored account record")
+	}
+	if err := verifyQueryResponse(tampered, path, header); err == nil {
+		t.Error("expected a response with an altered value to be rejected")
+	}
+
+	// answering with another account, with a perfectly good proof of that account
+	daveResp := provenQuery(t, athenaApp, "user/dave/auth")
+	redirected := provenQuery(t, athenaApp, path)
+	redirected.Key = daveResp.Key
+	redirected.Value = daveResp.Value
+	redirected.Proof.Ops[1] = daveResp.Proof.Ops[0]
+	if err := verifyQueryResponse(redirected, path, header); err == nil {
+		t.Error("expected a response following the symlink elsewhere to be rejected")
+	}
+
+	// claiming the symlink does not exist
+	missing := provenQuery(t, athenaApp, path)
+	missing.Key = missing.Proof.Ops[0].Key
+	missing.Value = nil
+	missing.Proof.Ops = missing.Proof.Ops[:1]
+	if err := verifyQueryResponse(missing, path, header); err == nil {
+		t.Error("expected a response denying the symlink exists to be rejected")
+	}
+
+	otherHeader := &types.Header{Height: header.Height, AppHash: bytes.Repeat([]byte{1}, len(header.AppHash))}
+	if err := verifyQueryResponse(resp, path, otherHeader); err == nil {
+		t.Error("expected a response to be rejected against a different app hash")
+	}
+}
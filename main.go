@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -34,7 +35,68 @@ func main() {
 	if len(args) > 0 {
 		switch args[0] {
 		case "init":
-			err := app.DoInit(config, logger)
+			var opts app.InitOptions
+			initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+			initFlags.StringVar(&opts.RootKeyFile, "root-key", "", "file holding the root user's key (generated if it does not exist)")
+			initFlags.StringVar(&opts.RootPubKey, "root-pubkey", "", "public key (base64url) of an existing root user, instead of -root-key")
+			initFlags.Parse(args[1:])
+			err := app.DoInit(config, opts, logger)
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "export":
+			var opts app.ExportOptions
+			exportFlags := flag.NewFlagSet("export", flag.ExitOnError)
+			exportFlags.Int64Var(&opts.Height, "height", 0, "block height to export the state as of (default the last committed block)")
+			exportFlags.StringVar(&opts.OutFile, "out", "", "file to write the dump to (default stdout)")
+			exportFlags.Parse(args[1:])
+			err := app.DoExport(config, opts, logger)
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "import":
+			var opts app.ImportOptions
+			importFlags := flag.NewFlagSet("import", flag.ExitOnError)
+			importFlags.BoolVar(&opts.ToStore, "store", false, "load the dump into an empty store, rather than the app_state of the genesis file")
+			importFlags.Parse(args[1:])
+			if importFlags.NArg() != 1 {
+				logger.Error("import requires the name of a dump file")
+				os.Exit(1)
+			}
+			opts.DumpFile = importFlags.Arg(0)
+			err := app.DoImport(config, opts, logger)
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "permissions":
+			var opts app.PermissionsOptions
+			permFlags := flag.NewFlagSet("permissions", flag.ExitOnError)
+			permFlags.StringVar(&opts.RootKeyFile, "root-key", "", "file holding the root user's key")
+			permFlags.StringVar(&opts.RPCAddr, "rpc", "", "RPC address of a node of the chain (default the local node)")
+			permFlags.BoolVar(&opts.Check, "check", false, "only report the rules that the chain is missing")
+			permFlags.Parse(args[1:])
+			if opts.RootKeyFile == "" {
+				logger.Error("permissions requires -root-key")
+				os.Exit(1)
+			}
+			err := app.DoPermissions(config, opts, logger)
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+			return
+		case "migrate":
+			var opts app.MigrateOptions
+			migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+			migrateFlags.BoolVar(&opts.Check, "check", false, "report the migrations that are due and what they would change, without changing anything")
+			migrateFlags.Parse(args[1:])
+			err := app.DoMigrate(config, opts, logger)
 			if err != nil {
 				logger.Error(err.Error())
 				os.Exit(1)
@@ -55,6 +117,19 @@ func main() {
 		logger.Error("  node - operate a full node")
 		logger.Error("  once - operate a full node for one cycle only (useful when creating a new chain)")
 		logger.Error("  init - create a new (empty) database.  This will create a new chain")
+		logger.Error("    -root-key <file> - file holding the root user's key (generated if it does not exist)")
+		logger.Error("    -root-pubkey <key> - public key of an existing root user, instead of -root-key")
+		logger.Error("  export - write the application state out as JSON (the node must be stopped)")
+		logger.Error("    -height <n> - block height to export (default the last committed block)")
+		logger.Error("    -out <file> - file to write to (default stdout)")
+		logger.Error("  import <file> - build the app_state of the genesis file from an exported state, to start a new chain")
+		logger.Error("    -store - load it into an empty store instead, restoring the node to the exported block")
+		logger.Error("  permissions - add the rules of the default permission table that the chain is missing (as root)")
+		logger.Error("    -root-key <file> - file holding the root user's key")
+		logger.Error("    -rpc <address> - RPC address of a node of the chain (default the local node)")
+		logger.Error("    -check - only report the missing rules")
+		logger.Error("  migrate - bring the database up to the current schema version (also done when the node starts)")
+		logger.Error("    -check - only report what would change")
 		return
 	}
 	if err != nil {